@@ -6,22 +6,45 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
+	"io/fs"
+	"maps"
+	"net"
 	"net/http"
 	"net/textproto"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
+	"text/tabwriter"
+	"time"
 
+	"github.com/surlykke/refude/internal/health"
+	"github.com/surlykke/refude/internal/lib/guard"
 	"github.com/surlykke/refude/internal/lib/utils"
+	"github.com/surlykke/refude/internal/lib/xdg"
+	"github.com/surlykke/refude/internal/options"
 )
 
 const operators = "GET POST PATCH DELETE"
 
+// Where refude-server is: host:port, or path to a unix socket
+var address = defaultAddress()
+
+// The api socket, if refude-server has made one, else the default tcp address
+func defaultAddress() string {
+	if info, err := os.Stat(xdg.ApiSocketPath); err == nil && info.Mode().Type() == fs.ModeSocket {
+		return xdg.ApiSocketPath
+	} else {
+		return options.DefaultAddress
+	}
+}
+
 type HeaderMap map[string]string
 
 func (hm *HeaderMap) String() string {
@@ -51,9 +74,11 @@ func fail(msg string) {
 
 func usage() {
 	_, _ = fmt.Fprintln(flag.CommandLine.Output(), "Usage: RefudeReq [options] path")
+	_, _ = fmt.Fprintln(flag.CommandLine.Output(), "       RefudeReq [options] health")
 	_, _ = fmt.Fprintln(flag.CommandLine.Output(), "options:")
 	flag.PrintDefaults()
 	_, _ = fmt.Fprintln(flag.CommandLine.Output(), "path: path to resource (eg. /application/firefox.desktop)")
+	_, _ = fmt.Fprintln(flag.CommandLine.Output(), "health: show state of refude-server subsystems")
 }
 
 /**
@@ -65,7 +90,17 @@ func usage() {
  */
 func perform(method string, headerMap map[string]string, path string) (string, map[string][]string, []byte, error) {
 	var client = &http.Client{}
-	var url = "http://localhost:7938" + path
+	var url = "http://" + address + path
+
+	if strings.HasPrefix(address, "/") {
+		var socketPath = address
+		url = "http://localhost" + path
+		client.Transport = &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", socketPath)
+			},
+		}
+	}
 
 	var request, err = http.NewRequest(method, url, nil)
 	if err != nil {
@@ -76,6 +111,12 @@ func perform(method string, headerMap map[string]string, path string) (string, m
 		request.Header.Set(key, value)
 	}
 
+	if _, ok := headerMap["Authorization"]; !ok {
+		if token := guard.ReadToken(); token != "" {
+			request.Header.Set("Authorization", "Bearer "+token)
+		}
+	}
+
 	if _, ok := headerMap["Accepts"]; !ok {
 		request.Header.Set("Accept", "*/*")
 	}
@@ -138,6 +179,9 @@ func completions(argStr string, _ bool) []string {
 		if (!hasX) && strings.HasPrefix("-X", curArg) {
 			comp = append(comp, "-X")
 		}
+		if strings.HasPrefix("health", curArg) {
+			comp = append(comp, "health")
+		}
 		if !strings.HasPrefix(curArg, "-") {
 			comp = append(comp, getStringlist("/complete?prefix="+curArg)...)
 		}
@@ -163,12 +207,18 @@ func main() {
 	var headerMap = make(HeaderMap)
 	flag.Var(&headerMap, "H", "Http header in the form <key>:<value>. May occur multiple times")
 	var method = flag.String("X", "GET", "Http method")
+	flag.StringVar(&address, "a", address, "Address of refude-server: host:port, or path to a unix socket")
 	flag.Parse()
 	if flag.NArg() != 1 {
 		flag.Usage()
 		os.Exit(1)
 	}
 
+	if flag.Arg(0) == "health" {
+		printHealth(headerMap)
+		return
+	}
+
 	protoAndStatus, headers, body, err := perform(*method, headerMap, flag.Arg(0))
 
 	if err != nil {
@@ -185,3 +235,33 @@ func main() {
 	fmt.Fprint(os.Stderr, "\r\n")
 	fmt.Println(string(body))
 }
+
+// Prints /health as a table. Exits with 1 if any subsystem has failed
+func printHealth(headerMap map[string]string) {
+	var reports []health.Report
+	if protoAndStatus, _, body, err := perform("GET", headerMap, "/health"); err != nil {
+		fail(err.Error())
+	} else if err := json.Unmarshal(body, &reports); err != nil {
+		fail(protoAndStatus + "\n" + string(body))
+	}
+
+	var anyFailed = false
+	var tw = tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "SUBSYSTEM\tSTATE\tUP SINCE\tCOUNTERS\tLAST ERROR")
+	for _, r := range reports {
+		var counters = make([]string, 0, len(r.Counters))
+		for _, name := range slices.Sorted(maps.Keys(r.Counters)) {
+			counters = append(counters, fmt.Sprintf("%s=%d", name, r.Counters[name]))
+		}
+		var lastError = r.LastError
+		if r.LastErrorTime != nil {
+			lastError = r.LastErrorTime.Format(time.TimeOnly) + " " + lastError
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", r.Name, r.State, r.Started.Format(time.DateTime), strings.Join(counters, " "), lastError)
+		anyFailed = anyFailed || r.State == health.Failed
+	}
+	tw.Flush()
+	if anyFailed {
+		os.Exit(1)
+	}
+}
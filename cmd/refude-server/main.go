@@ -5,23 +5,41 @@
 package main
 
 import (
+	"context"
 	"log"
+	"net"
 	"net/http"
+	"os"
+	"os/signal"
 	"strings"
+	"sync"
+	"syscall"
+	"time"
 
 	"github.com/surlykke/refude/internal/applications"
+	"github.com/surlykke/refude/internal/batch"
 	"github.com/surlykke/refude/internal/browser"
+	"github.com/surlykke/refude/internal/config"
 	"github.com/surlykke/refude/internal/desktop"
 	"github.com/surlykke/refude/internal/desktopactions"
 	"github.com/surlykke/refude/internal/file"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/icons"
+	"github.com/surlykke/refude/internal/lib/entity"
+	"github.com/surlykke/refude/internal/lib/guard"
+	"github.com/surlykke/refude/internal/lib/instance"
+	"github.com/surlykke/refude/internal/lib/listen"
 	"github.com/surlykke/refude/internal/lib/respond"
 	"github.com/surlykke/refude/internal/lib/utils"
+	"github.com/surlykke/refude/internal/lib/xdg"
 	"github.com/surlykke/refude/internal/network"
 	"github.com/surlykke/refude/internal/notifications"
 	"github.com/surlykke/refude/internal/notifygui"
 	"github.com/surlykke/refude/internal/options"
+	"github.com/surlykke/refude/internal/plugin"
 	"github.com/surlykke/refude/internal/power"
+	"github.com/surlykke/refude/internal/rpc"
+	"github.com/surlykke/refude/internal/schema"
 	"github.com/surlykke/refude/internal/search"
 	"github.com/surlykke/refude/internal/watch"
 	"github.com/surlykke/refude/internal/wayland"
@@ -30,41 +48,133 @@ import (
 func main() {
 	var opts = options.GetOpts()
 
-	go wayland.Run(opts.IgnoreWinAppIds)
-	go applications.Run()
-	go notifications.Run(opts.NoNotifications)
-	go notifygui.StartGui(opts.NoNotifications)
+	if err := instance.Lock(xdg.LockPath); err != nil {
+		log.Fatal("Could not lock ", xdg.LockPath, ": ", err)
+	}
+
+	// Before anything gets to launch processes, which would inherit the passed file descriptors
+	var activatedListeners, err = listen.Activated()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var signals = make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT)
 
-	go icons.Run()
-	go power.Run(opts.NoTrayBattery)
-	go browser.Run()
-	go file.Run()
-	go desktopactions.Run()
+	// Long-lived subsystems that wait on events stop when ctx is done
+	var ctx, cancel = context.WithCancel(context.Background())
+
+	health.Go("config", config.Run)
+	health.Go("wayland", func() { wayland.Run(ctx, opts.IgnoreWinAppIds) })
+	health.Go("applications", applications.Run)
+	health.Setup("notifications", func() { notifications.Run(opts.NoNotifications) })
+	health.Setup("notifygui", func() { notifygui.StartGui(opts.NoNotifications) })
+
+	health.Go("icons", icons.Run)
+	health.Go("power", func() { power.Run(opts.NoTrayBattery) })
+	health.Go("browser", browser.Run)
+	health.Go("file", func() { file.Run(ctx) })
+	health.Setup("desktopactions", desktopactions.Run)
 	go desktop.Run()
 	go search.Run()
-	go network.Run()
-	go watch.Run()
+	health.Go("network", network.Run)
+	health.Setup("plugins", plugin.Run)
+	go watch.Run(ctx)
+	go batch.Run()
+	go rpc.Run()
+	go schema.Run()
+	go health.Run()
 
 	http.HandleFunc("GET /complete", CompleteHandler)
 
-	if err := http.ListenAndServe(":7938", nil); err != nil {
-		log.Print("http.ListenAndServe failed:", err)
+	apiGuard, err := guard.Make(respond.WithProblems(http.DefaultServeMux), opts.RequireToken, desktopUrl(opts.Address))
+	if err != nil {
+		log.Fatal("Could not set up access guard:", err)
+	}
+
+	var servers = serve(activatedListeners, opts.Address, apiGuard)
+
+	log.Print("Got ", <-signals, ", shutting down")
+	health.Shutdown()
+	cancel()
+	shutdown(servers)
+}
+
+// The desktop page is at localhost, as the manifest of the desktop page and the browser tab filter have it,
+// so the cookie set by the launcher is sent by the page
+func desktopUrl(address string) string {
+	if _, port, err := net.SplitHostPort(address); err == nil {
+		address = net.JoinHostPort("localhost", port)
+	}
+	return "http://" + address + "/desktop/"
+}
+
+// Serves on listeners, if any, else on address and the api socket
+func serve(listeners []net.Listener, address string, apiGuard *guard.Guard) []*http.Server {
+	if len(listeners) == 0 {
+		if listener, err := listen.Tcp(address); err != nil {
+			log.Print("Could not listen on ", address, ": ", err)
+		} else {
+			listeners = append(listeners, listener)
+		}
+		if listener, err := listen.Unix(xdg.ApiSocketPath); err != nil {
+			log.Print("Could not listen on ", xdg.ApiSocketPath, ": ", err)
+		} else {
+			listeners = append(listeners, listener)
+		}
 	}
 
+	var servers = make([]*http.Server, 0, len(listeners))
+	for _, listener := range listeners {
+		var handler = apiGuard
+		if _, ok := listener.Addr().(*net.UnixAddr); ok {
+			handler = apiGuard.WithoutToken()
+		}
+		// Long-lived handlers, like /watch, should watch the request context, which is cancelled on shutdown
+		var ctx, cancel = context.WithCancel(context.Background())
+		var server = &http.Server{Handler: handler, BaseContext: func(net.Listener) context.Context { return ctx }}
+		server.RegisterOnShutdown(cancel)
+		servers = append(servers, server)
+		go func() {
+			if err := server.Serve(listener); err != http.ErrServerClosed {
+				log.Print("Serving on ", listener.Addr(), " failed: ", err)
+			}
+		}()
+	}
+	return servers
+}
+
+const drainTimeout = 3 * time.Second
+
+// Lets ongoing requests finish, and releases what a new instance of refude-server would need
+func shutdown(servers []*http.Server) {
+	var ctx, cancel = context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, server := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := server.Shutdown(ctx); err != nil {
+				server.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	notifications.Shutdown()
+	power.Shutdown()
+	browser.Shutdown()
+	search.Shutdown()
 }
 
 func CompleteHandler(w http.ResponseWriter, r *http.Request) {
 	var filtered = make([]string, 0, 1000)
 	var allPaths = [][]string{
-		{"/flash", "/icon?name=", "/desktop/", "/complete?prefix=", "/search?", "/watch"},
-		icons.ThemeMap.GetPaths(),
-		wayland.WindowMap.GetPaths(),
-		applications.AppMap.GetPaths(),
-		applications.MimeMap.GetPaths(),
-		notifications.NotificationMap.GetPaths(),
-		power.DeviceMap.GetPaths(),
-		browser.TabMap.GetPaths(),
-		browser.BookmarkMap.GetPaths(),
+		{"/flash", "/icon?name=", "/desktop/", "/complete?prefix=", "/search?", "/search/frecency", "/watch", "/batch", "/rpc", "/schema", "/health", "/config"},
+	}
+	for _, reg := range entity.Registered() {
+		allPaths = append(allPaths, reg.GetPaths())
 	}
 	var prefix = utils.QueryParam(r, "prefix")
 	for _, pathList := range allPaths {
@@ -4,15 +4,15 @@
 # are needed by the services.
 #
 
+RUNTIME_DIR=${XDG_RUNTIME_DIR:-/tmp}
+
+# A running refude-server shuts down gracefully on SIGTERM. It holds a lock
+# on org.refude.lock until it is gone, so wait for that.
 pkill refude-server
-# Wait for port to 7938 be released
-for i in {1..10}; do
-	if ! netstat -ltnp 2>/dev/null | grep 7938; then 
-		break
-	fi
-	sleep 0.5
-done
+if ! flock --wait 10 $RUNTIME_DIR/org.refude.lock true; then
+	echo "refude-server did not stop" >&2
+	exit 1
+fi
 
-LOGFILE=${XDG_RUNTIME_DIR:-/tmp}/RefudeServices.log
+LOGFILE=$RUNTIME_DIR/RefudeServices.log
 nohup refude-server $REFUDE_SWITCHES >$LOGFILE 2>$LOGFILE &
-
@@ -9,6 +9,7 @@ require (
 	github.com/pkg/errors v0.9.1
 	github.com/shirou/gopsutil/v4 v4.25.6
 	golang.org/x/net v0.42.0
+	golang.org/x/text v0.27.0
 )
 
 require (
@@ -7,10 +7,11 @@ package applications
 
 import (
 	"fmt"
-	"os"
 	"regexp"
+	"slices"
 	"strings"
 
+	"github.com/surlykke/refude/internal/config"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/xdg"
 )
@@ -45,8 +46,8 @@ func (d *DesktopApplication) OmitFromSearch() bool {
 	return d.NoDisplay
 }
 
-func (d *DesktopApplication) Run(arg string) error {
-	return run(d.Exec, arg, d.Terminal)
+func (d *DesktopApplication) Run(args ...string) error {
+	return run(d.Exec, args, d.Terminal)
 }
 
 type DesktopAction struct {
@@ -56,21 +57,25 @@ type DesktopAction struct {
 	Icon string
 }
 
-func (d *DesktopApplication) DoPost(action string) (bool, error) {
+// args are files or urls to open
+func (d *DesktopApplication) DoPost(action string, args []string) (bool, error) {
 	if action == "" {
-		return postHelper(d.Exec, d.Terminal)
+		return postHelper(d.Exec, args, d.Terminal)
 	} else {
 		for _, dac := range d.DesktopActions {
 			if action == dac.id {
-				return postHelper(dac.Exec, d.Terminal)
+				return postHelper(dac.Exec, args, d.Terminal)
 			}
 		}
 	}
 	return false, nil
 }
 
-func postHelper(exec string, terminal bool) (bool, error) {
-	if err := run(exec, "", terminal); err != nil {
+// Args posted to an application that takes none are refused, rather than dropped
+func postHelper(exec string, args []string, terminal bool) (bool, error) {
+	if len(args) > 0 && !argPlaceholders.MatchString(exec) {
+		return false, entity.ArgumentError{Problem: "does not take files or urls"}
+	} else if err := run(exec, args, terminal); err != nil {
 		return false, err
 	} else {
 		return true, nil
@@ -78,11 +83,30 @@ func postHelper(exec string, terminal bool) (bool, error) {
 }
 
 var argPlaceholders = regexp.MustCompile("%[uUfF]")
+var listPlaceholders = regexp.MustCompile("^%[UF]$")
+var singlePlaceholders = regexp.MustCompile("%[uf]")
 
-func run(exec string, arg string, inTerminal bool) error {
-	var argv = strings.Fields(exec)
-	for i := 0; i < len(argv); i++ {
-		argv[i] = argPlaceholders.ReplaceAllString(argv[i], arg)
+// If exec takes a list of arguments (%F or %U) all args are passed in one go. If it takes
+// a single argument (%f or %u), exec is run once for each arg. If it takes none, it is run once, and args dropped
+func run(exec string, args []string, inTerminal bool) error {
+	if len(args) > 1 && singlePlaceholders.MatchString(exec) && !slices.ContainsFunc(strings.Fields(exec), listPlaceholders.MatchString) {
+		for _, arg := range args {
+			if err := run(exec, []string{arg}, inTerminal); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var argv = make([]string, 0, 10)
+	for _, field := range strings.Fields(exec) {
+		if listPlaceholders.MatchString(field) {
+			argv = append(argv, args...)
+		} else if len(args) > 0 {
+			argv = append(argv, argPlaceholders.ReplaceAllString(field, args[0]))
+		} else {
+			argv = append(argv, argPlaceholders.ReplaceAllString(field, ""))
+		}
 	}
 
 	// Get rid of empty arguments
@@ -96,9 +120,9 @@ func run(exec string, arg string, inTerminal bool) error {
 	argv = argv[0:left]
 
 	if inTerminal {
-		var terminal, ok = os.LookupEnv("TERMINAL")
-		if !ok {
-			return fmt.Errorf("trying to run %s in terminal, but env variable TERMINAL not set", exec)
+		var terminal = config.Get().Terminal
+		if terminal == "" {
+			return fmt.Errorf("trying to run %s in terminal, but no terminal configured (env variable TERMINAL or Terminal in %s)", exec, config.Get().Path)
 		}
 		argv = append([]string{terminal, "-e"}, argv...)
 	}
@@ -6,8 +6,10 @@
 package applications
 
 import (
+	"encoding/json"
 	"os"
 	"regexp"
+	"strings"
 
 	"github.com/pkg/errors"
 	"github.com/surlykke/refude/internal/lib/entity"
@@ -56,3 +58,33 @@ func MakeMimetype(id string) (*Mimetype, error) {
 		return &mt, nil
 	}
 }
+
+// Patching Applications sets the default applications for the mimetype, in
+// order of preference. The choice is written to mimeapps.list in the users config dir.
+func (this *Mimetype) DoPatch(patch map[string]json.RawMessage) (entity.Servable, error) {
+	var appIds []string
+	if err := entity.CheckPatchFields(patch, "Applications"); err != nil {
+		return nil, err
+	} else if _, err := entity.PatchField(patch, "Applications", &appIds); err != nil {
+		return nil, err
+	}
+	for _, appId := range appIds {
+		if _, ok := AppMap.Get(appId); !ok {
+			return nil, entity.PatchError{Field: "Applications", Problem: "unknown application: " + appId}
+		}
+	}
+	if err := writeDefaultApps(this.Id, appIds); err != nil {
+		return nil, err
+	}
+	var copy = *this
+	copy.Applications = appendIfNotThere(appIds, this.Applications...)
+	return &copy, nil
+}
+
+func writeDefaultApps(mimetypeId string, appIds []string) error {
+	var value = ""
+	if len(appIds) > 0 {
+		value = strings.Join(appIds, ".desktop;") + ".desktop;"
+	}
+	return xdg.SetIniEntry(xdg.ConfigHome+"/mimeapps.list", "Default Applications", mimetypeId, value)
+}
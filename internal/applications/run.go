@@ -11,16 +11,21 @@ import (
 	"time"
 
 	"github.com/fsnotify/fsnotify"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/xdg"
 )
 
-var AppMap = entity.MakeMap[string, *DesktopApplication]("/application/")
-var MimeMap = entity.MakeMap[string, *Mimetype]("/mimetype/")
+var AppMap = entity.Register(entity.MakeMap[string, *DesktopApplication]("/application/"), entity.SearchOptions{MinTermLength: 1})
+var MimeMap = entity.Register(entity.MakeMap[string, *Mimetype]("/mimetype/"), entity.SearchOptions{Exclude: true})
+
+var subsystem = health.Get("applications")
 
 func Run() {
 	AppMap.Serve()
 	MimeMap.Serve()
+	subsystem.Gauge("applications", AppMap.Len)
+	subsystem.Gauge("mimetypes", MimeMap.Len)
 	var desktopFileEvents = make(chan struct{})
 	go watchForDesktopFiles(desktopFileEvents)
 
@@ -79,6 +84,7 @@ func watchForDesktopFiles(events chan struct{}) {
 		if xdg.DirOrFileExists(f) {
 			if err := watcher.Add(f); err != nil {
 				log.Print("Could not watch:", f, ":", err)
+				subsystem.Degrade(err)
 			}
 		}
 	}
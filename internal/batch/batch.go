@@ -0,0 +1,158 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package batch
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+
+	"github.com/surlykke/refude/internal/lib/respond"
+	"github.com/surlykke/refude/internal/lib/utils"
+)
+
+/*
+ * POST /batch takes a json list of operations, eg:
+ *
+ *   [{"method": "DELETE", "path": "/notification/17"},
+ *    {"method": "POST", "path": "/application/gimp", "action": "", "body": ["/home/me/a.png", "/home/me/b.png"]}]
+ *
+ * Each operation is performed as if it had been requested on its own, and the response lists the
+ * outcome of each. With query parameter stopOnError=true, operations following a failed one are skipped.
+ */
+type Operation struct {
+	Method  string
+	Path    string
+	Action  string
+	Term    string // Search term that led to the entity, see entity.Activation
+	Body    json.RawMessage
+	IfMatch string
+}
+
+type Outcome struct {
+	Status  int             `json:"status,omitempty"`
+	Body    json.RawMessage `json:"body,omitempty"`
+	Skipped bool            `json:"skipped,omitempty"`
+}
+
+func Run() {
+	http.HandleFunc("POST /batch", ServeHTTP)
+}
+
+func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var operations []Operation
+	if err := json.NewDecoder(r.Body).Decode(&operations); err != nil {
+		respond.UnprocessableEntity(w, r, err)
+		return
+	}
+	var stopOnError = utils.QueryParam(r, "stopOnError") == "true"
+
+	var outcomes = make([]Outcome, len(operations))
+	var failed = false
+	for i, op := range operations {
+		if failed && stopOnError {
+			outcomes[i] = Outcome{Skipped: true}
+		} else {
+			outcomes[i] = perform(r, op, "POST", "PATCH", "DELETE")
+			failed = failed || outcomes[i].Status >= 300
+		}
+	}
+	respond.AsJson(w, outcomes)
+}
+
+func perform(r *http.Request, op Operation, allowedMethods ...string) Outcome {
+	if !slices.Contains(allowedMethods, strings.ToUpper(op.Method)) {
+		return failed(op, "method-not-allowed", http.StatusMethodNotAllowed, op.Method+" not allowed in a batch")
+	}
+	return Perform(r, op)
+}
+
+var mux = respond.WithProblems(http.DefaultServeMux)
+
+// Those that stream, or take over the connection, can't be performed here
+var unperformable = []string{"/batch", "/watch", "/rpc"}
+
+// Performs op as if it had been requested on its own, on behalf of r. Also used by the websocket api
+func Perform(r *http.Request, op Operation) Outcome {
+	var method = strings.ToUpper(op.Method)
+	if !strings.HasPrefix(op.Path, "/") {
+		return failed(op, "not-found", http.StatusNotFound, "path must start with '/'")
+	}
+
+	var query = url.Values{}
+	if op.Action != "" {
+		query.Set("action", op.Action)
+	}
+	if op.Term != "" {
+		query.Set("term", op.Term)
+	}
+	var target = op.Path
+	if len(query) > 0 {
+		target = target + "?" + query.Encode()
+	}
+	var req, err = http.NewRequestWithContext(r.Context(), method, target, bytes.NewReader(op.Body))
+	if err != nil {
+		return failed(op, "unprocessable-entity", http.StatusUnprocessableEntity, err.Error())
+	} else if slices.ContainsFunc(unperformable, func(prefix string) bool { return strings.HasPrefix(req.URL.Path, prefix) }) {
+		return failed(op, "not-found", http.StatusNotFound, req.URL.Path+" can't be performed in a batch")
+	}
+	req.RemoteAddr = r.RemoteAddr
+	if len(op.Body) > 0 {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if op.IfMatch != "" {
+		req.Header.Set("If-Match", op.IfMatch)
+	}
+
+	var rec = &recorder{header: make(http.Header)}
+	mux.ServeHTTP(rec, req)
+	rec.WriteHeader(http.StatusOK) // In case the handler wrote nothing
+	var res = Outcome{Status: rec.status}
+	if body := bytes.TrimSpace(rec.body.Bytes()); json.Valid(body) {
+		res.Body = body
+	} else if len(body) > 0 {
+		res.Body = respond.ToJson(string(body))
+	}
+	return res
+}
+
+// An operation that could not be performed, with a body as respond would give it
+func failed(op Operation, problemType string, status int, detail string) Outcome {
+	var p = respond.Problem{
+		Type:   problemType,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Path:   op.Path,
+		Action: op.Action,
+	}
+	return Outcome{Status: status, Body: respond.ToJson(p)}
+}
+
+// Collects the response of an operation
+type recorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (this *recorder) Header() http.Header {
+	return this.header
+}
+
+func (this *recorder) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
+	}
+}
+
+func (this *recorder) Write(b []byte) (int, error) {
+	this.WriteHeader(http.StatusOK)
+	return this.body.Write(b)
+}
@@ -16,7 +16,7 @@ type Bookmark struct {
 	ExternalUrl string
 }
 
-func (this *Bookmark) DoPost(action string) (bool, error) {
+func (this *Bookmark) DoPost(action string, args []string) (bool, error) {
 	xdg.RunCmd("xdg-open", this.ExternalUrl)
 	return true, nil
 }
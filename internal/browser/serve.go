@@ -6,6 +6,7 @@
 package browser
 
 import (
+	"context"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
@@ -14,8 +15,11 @@ import (
 	"net"
 	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/pkg/errors"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/respond"
 	"github.com/surlykke/refude/internal/lib/utils"
@@ -23,14 +27,15 @@ import (
 	"github.com/surlykke/refude/pkg/pubsub"
 )
 
-var TabMap = entity.MakeMap[string, *Tab]("/tab/")
-var BookmarkMap = entity.MakeMap[string, *Bookmark]("/bookmark/")
+var TabMap = entity.Register(entity.MakeMap[string, *Tab]("/tab/").Coalesce(50*time.Millisecond), entity.SearchOptions{})
+var BookmarkMap = entity.Register(entity.MakeMap[string, *Bookmark]("/bookmark/"), entity.SearchOptions{MinTermLength: 3})
 
 // Data sent to the browser
 type browserCommand struct {
 	BrowserId string `json:"browserId"`
-	Cmd       string `json:"cmd"` // "report", "focus" or "close"
+	Cmd       string `json:"cmd"` // "report", "focus", "navigate" or "close"
 	TabId     string `json:"tabId"`
+	Url       string `json:"url,omitempty"` // With "navigate"
 }
 
 var browserCommands = pubsub.MakePublisher[browserCommand]()
@@ -62,25 +67,43 @@ type browserData struct {
 	return bind.Accepted()
 }*/
 
+var subsystem = health.Get("browser")
+
 func Run() {
 	TabMap.Serve()
 	BookmarkMap.Serve()
+	subsystem.Gauge("tabs", TabMap.Len)
 
 	os.Remove(xdg.NmSocketPath)
 	if listener, err := net.Listen("unix", xdg.NmSocketPath); err != nil {
 		log.Print(err)
+		subsystem.Fail(err)
 		return
 	} else {
+		nmListener.Store(&listener)
 		for {
-			if conn, err := listener.Accept(); err != nil {
+			if conn, err := listener.Accept(); errors.Is(err, net.ErrClosed) {
+				return
+			} else if err != nil {
 				log.Print(err)
 			} else {
+				subsystem.Count("connections")
 				go receive(conn)
 			}
 		}
 	}
 }
 
+var nmListener atomic.Pointer[net.Listener]
+
+// Stops listening for browser connections, and removes the socket
+func Shutdown() {
+	if listener := nmListener.Load(); listener != nil {
+		(*listener).Close()
+	}
+	os.Remove(xdg.NmSocketPath)
+}
+
 func receive(conn net.Conn) {
 	defer conn.Close()
 	if data, err := readMsg(conn); err != nil {
@@ -90,7 +113,10 @@ func receive(conn net.Conn) {
 		defer clean(browserId)
 		var browserName = browserNameFromId(browserId)
 		log.Print("Connected to ", browserName)
-		go send(browserId, conn)
+		// Stops send when the browser disconnects
+		var ctx, cancel = context.WithCancel(context.Background())
+		defer cancel()
+		go send(ctx, browserId, conn)
 
 		for {
 			var brd browserData
@@ -162,18 +188,18 @@ func browserNameFromId(id string) string {
 
 var reportCommand = respond.ToJson(browserCommand{Cmd: "report"})
 
-func send(browserId string, conn net.Conn) {
-	var subscription = browserCommands.Subscribe()
+func send(ctx context.Context, browserId string, conn net.Conn) {
+	var subscription = browserCommands.SubscribeWhere(func(cmd browserCommand) bool { return cmd.BrowserId == browserId })
+	defer subscription.Close()
 	if err := writeMsg(conn, reportCommand); err != nil {
 		log.Print(err)
 		return
 	}
 	for {
-		var cmd = subscription.Next()
-		if cmd.BrowserId == browserId {
-			if err := writeMsg(conn, respond.ToJson(cmd)); err != nil {
-				return
-			}
+		if cmd, err := subscription.NextContext(ctx); err != nil {
+			return
+		} else if err := writeMsg(conn, respond.ToJson(cmd)); err != nil {
+			return
 		}
 	}
 }
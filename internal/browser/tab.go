@@ -6,6 +6,7 @@
 package browser
 
 import (
+	"net/url"
 	"strings"
 
 	"github.com/surlykke/refude/internal/lib/entity"
@@ -18,8 +19,16 @@ type Tab struct {
 	Url       string
 }
 
-func (this *Tab) DoPost(action string) (bool, error) {
-	browserCommands.Publish(browserCommand{BrowserId: this.BrowserId, TabId: this.Id, Cmd: "focus"})
+// If an url is given as argument, the tab navigates to that. Only http and https urls are accepted
+func (this *Tab) DoPost(action string, args []string) (bool, error) {
+	if len(args) > 0 {
+		if u, err := url.Parse(args[0]); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return false, entity.ArgumentError{Problem: "not an http or https url: " + args[0]}
+		}
+		browserCommands.Publish(browserCommand{BrowserId: this.BrowserId, TabId: this.Id, Cmd: "navigate", Url: args[0]})
+	} else {
+		browserCommands.Publish(browserCommand{BrowserId: this.BrowserId, TabId: this.Id, Cmd: "focus"})
+	}
 	return true, nil
 }
 
@@ -0,0 +1,220 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+
+/*
+ * Configuration read from $XDG_CONFIG_HOME/refude/refude.conf, eg:
+ *
+ *   [Files]
+ *   Dirs=~;~/Desktop;~/Downloads;~/Projects
+ *
+ *   [Battery]
+ *   Critical=5
+ *   Low=10
+ *   Notice=15
+ *
+ *   [Notifications]
+ *   LowTimeout=2000
+ *   NormalTimeout=10000
+ *
+ *   [Applications]
+ *   Terminal=foot
+ *
+ *   [Icons]
+ *   Theme=Papirus
+ *
+ * Timeouts are in milliseconds, and must be positive. Anything not given falls back to defaults, and for Terminal
+ * and Theme to the environment variables TERMINAL and REFUDE_ICON_THEME. The file is watched, and changes take effect right away.
+ */
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/surlykke/refude/internal/health"
+	"github.com/surlykke/refude/internal/lib/respond"
+	"github.com/surlykke/refude/internal/lib/utils"
+	"github.com/surlykke/refude/internal/lib/xdg"
+	"github.com/surlykke/refude/pkg/pubsub"
+)
+
+type Config struct {
+	Path          string   // Where the config was read from
+	Errors        []string `json:",omitempty"` // Problems with the file. Those settings have their defaults
+	FileDirs      []string
+	Battery       Battery
+	Notifications Notifications
+	Terminal      string
+	IconTheme     string
+}
+
+// Percentages. At or below Critical a critical notification is shown, when
+// going below Low or Notice, a normal one
+type Battery struct {
+	Critical float64
+	Low      float64
+	Notice   float64
+}
+
+// Milliseconds. Upper limit on how long notifications with urgency low or normal are shown
+type Notifications struct {
+	LowTimeout    int32
+	NormalTimeout int32
+}
+
+var dir = xdg.ConfigHome + "/refude"
+var path = dir + "/refude.conf"
+
+var current atomic.Pointer[Config]
+
+// Publishes the new config whenever it changes
+var Changes = pubsub.MakePublisher[*Config]()
+
+var subsystem = health.Get("config")
+
+func init() {
+	current.Store(read())
+}
+
+func Get() *Config {
+	return current.Load()
+}
+
+func defaults() *Config {
+	return &Config{
+		Path:          path,
+		FileDirs:      []string{xdg.Home, xdg.DesktopDir, xdg.DownloadDir, xdg.TemplatesDir, xdg.PublicshareDir, xdg.DocumentsDir, xdg.MusicDir, xdg.PicturesDir, xdg.VideosDir},
+		Battery:       Battery{Critical: 5, Low: 10, Notice: 15},
+		Notifications: Notifications{LowTimeout: 2_000, NormalTimeout: 10_000},
+		Terminal:      os.Getenv("TERMINAL"),
+		IconTheme:     os.Getenv("REFUDE_ICON_THEME"),
+	}
+}
+
+func read() *Config {
+	var conf = defaults()
+	var iniFile, err = xdg.ReadIniFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return conf
+	} else if err != nil {
+		conf.Errors = append(conf.Errors, err.Error())
+		return conf
+	}
+
+	var get = func(group, key string, setter func(string) error) {
+		if g := iniFile.FindGroup(group); g != nil {
+			if value, ok := g.Entries[key]; ok {
+				if err := setter(strings.TrimSpace(value)); err != nil {
+					conf.Errors = append(conf.Errors, fmt.Sprintf("[%s] %s: %s", group, key, err))
+				}
+			}
+		}
+	}
+
+	get("Files", "Dirs", func(s string) error {
+		conf.FileDirs = conf.FileDirs[:0]
+		for _, d := range utils.Split(s, ";") {
+			conf.FileDirs = append(conf.FileDirs, expandHome(strings.TrimSpace(d)))
+		}
+		return nil
+	})
+	get("Battery", "Critical", percentage(&conf.Battery.Critical))
+	get("Battery", "Low", percentage(&conf.Battery.Low))
+	get("Battery", "Notice", percentage(&conf.Battery.Notice))
+	get("Notifications", "LowTimeout", milliseconds(&conf.Notifications.LowTimeout))
+	get("Notifications", "NormalTimeout", milliseconds(&conf.Notifications.NormalTimeout))
+	get("Applications", "Terminal", func(s string) error { conf.Terminal = s; return nil })
+	get("Icons", "Theme", func(s string) error { conf.IconTheme = s; return nil })
+
+	return conf
+}
+
+func percentage(dest *float64) func(string) error {
+	return func(s string) error {
+		if f, err := strconv.ParseFloat(s, 64); err != nil || f < 0 || f > 100 {
+			return errors.New("should be a number between 0 and 100")
+		} else {
+			*dest = f
+			return nil
+		}
+	}
+}
+
+func milliseconds(dest *int32) func(string) error {
+	return func(s string) error {
+		if i, err := strconv.ParseInt(s, 10, 32); err != nil || i <= 0 {
+			return errors.New("should be a positive number of milliseconds")
+		} else {
+			*dest = int32(i)
+			return nil
+		}
+	}
+}
+
+func expandHome(p string) string {
+	if p == "~" {
+		return xdg.Home
+	} else if rest, ok := strings.CutPrefix(p, "~/"); ok {
+		return filepath.Join(xdg.Home, rest)
+	} else if !filepath.IsAbs(p) {
+		return filepath.Join(xdg.Home, p)
+	} else {
+		return filepath.Clean(p)
+	}
+}
+
+func reload() {
+	var conf = read()
+	current.Store(conf)
+	if len(conf.Errors) > 0 {
+		subsystem.Degrade(errors.New(strings.Join(conf.Errors, "; ")))
+	} else {
+		subsystem.Recover()
+	}
+	Changes.Publish(conf)
+}
+
+func Run() {
+	http.HandleFunc("GET /config", func(w http.ResponseWriter, r *http.Request) {
+		respond.AsJson(w, Get())
+	})
+	reload()
+
+	// We watch the directory, as editors often replace the file rather than write to it
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		subsystem.Degrade(err)
+		return
+	}
+	var watcher, err = fsnotify.NewWatcher()
+	if err != nil {
+		subsystem.Degrade(err)
+		return
+	} else if err := watcher.Add(dir); err != nil {
+		subsystem.Degrade(err)
+		return
+	}
+
+	for {
+		select {
+		case ev := <-watcher.Events:
+			if ev.Name == path {
+				log.Print("Reloading ", path)
+				reload()
+			}
+		case err := <-watcher.Errors:
+			log.Print("Watching ", dir, ": ", err)
+		}
+	}
+}
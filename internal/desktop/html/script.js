@@ -29,7 +29,10 @@ let doEnter = (ctrl, shift) => {
 	} else {
 		href = document.activeElement?.dataset.href
 		if (href) {
-			fetch(href, { method: "post" }).then(resp => resp.ok && !shift && dismiss())
+			// The term tells refude-server what we searched for to get here, so it can rank accordingly
+			let url = new URL(href, location)
+			url.searchParams.set("term", term)
+			fetch(url, { method: "post" }).then(resp => resp.ok && !shift && dismiss())
 		}
 	}
 }
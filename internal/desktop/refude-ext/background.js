@@ -57,6 +57,14 @@ port.onMessage.addListener(function(obj) {
 				chrome.windows.update(t.windowId, { focused: true })
 			})
 		}
+	} else if ("navigate" === obj.cmd) {
+		let tabId = parseInt(obj.tabId)
+		if (tabId && obj.url) {
+			chrome.tabs.get(tabId).then(t => {
+				chrome.tabs.update(tabId, { url: obj.url, active: true })
+				chrome.windows.update(t.windowId, { focused: true })
+			})
+		}
 	}
 });
 
@@ -59,7 +59,7 @@ func Run() {
 
 type Resourceline struct {
 	Icon        string
-	Title       string
+	Title       []TitlePart
 	Comment     string
 	Href        string
 	Path        string
@@ -74,7 +74,7 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 
 	for _, r := range search.Search(term) {
 
-		var line = Resourceline{Icon: string(r.Icon), Title: r.Title, Comment: r.Subtitle}
+		var line = Resourceline{Icon: string(r.Icon), Title: titleParts(r), Comment: r.Subtitle}
 		var links = r.GetLinks(entity.OrgRefudeAction)
 		if len(links) > 0 {
 			line.Href = links[0].Href
@@ -86,12 +86,38 @@ func SearchHandler(w http.ResponseWriter, r *http.Request) {
 
 	var b bytes.Buffer
 	if err := rowTemplate.Execute(&b, lines); err != nil {
-		respond.ServerError(w, err)
+		respond.ServerError(w, r, err)
 	} else {
 		respond.AsHtml(w, string(b.Bytes()))
 	}
 }
 
+// Matched parts of titles are shown in bold
+type TitlePart struct {
+	Text    string
+	Matched bool
+}
+
+func titleParts(r search.Ranked) []TitlePart {
+	if r.Match == nil || r.Match.Field != "title" {
+		return []TitlePart{{Text: r.Title}}
+	}
+	var runes = []rune(r.Title)
+	var parts = make([]TitlePart, 0, 2*len(r.Match.Spans)+1)
+	var pos = 0
+	for _, span := range r.Match.Spans {
+		if span.Start > pos {
+			parts = append(parts, TitlePart{Text: string(runes[pos:span.Start])})
+		}
+		parts = append(parts, TitlePart{Text: string(runes[span.Start:span.End]), Matched: true})
+		pos = span.End
+	}
+	if pos < len(runes) {
+		parts = append(parts, TitlePart{Text: string(runes[pos:])})
+	}
+	return parts
+}
+
 type Detail struct {
 	Name string
 	Href string
@@ -101,9 +127,9 @@ func DetailsHandler(w http.ResponseWriter, r *http.Request) {
 	var b bytes.Buffer
 	var resPath = utils.QueryParam(r, "path")
 	if base, ok := search.SearchByPath(resPath); !ok {
-		respond.NotFound(w)
+		respond.NotFound(w, r)
 	} else if err := detailsTemplate.Execute(&b, base.GetLinks(entity.OrgRefudeAction)); err != nil {
-		respond.ServerError(w, err)
+		respond.ServerError(w, r, err)
 	} else {
 		respond.AsHtml(w, string(b.Bytes()))
 	}
@@ -22,7 +22,7 @@ var actionMethod = map[string]string{
 	"suspend":  "org.freedesktop.login1.Manager.Suspend",
 }
 
-var PowerActions = entity.MakeMap[string, *StartResource]("/start/")
+var PowerActions = entity.Register(entity.MakeMap[string, *StartResource]("/start/"), entity.SearchOptions{MinTermLength: 3})
 
 func Run() {
 	PowerActions.Serve()
@@ -33,7 +33,7 @@ type StartResource struct {
 	dbusMethod string
 }
 
-func (this *StartResource) DoPost(action string) (bool, error) {
+func (this *StartResource) DoPost(action string, args []string) (bool, error) {
 	if action != "" {
 		return false, nil
 	} else if conn, err := dbus.SystemBus(); err != nil {
@@ -103,7 +103,7 @@ func readEntries(dir string) []fs.DirEntry {
 	}
 }
 
-func (f *File) DoPost(action string) (bool, error) {
+func (f *File) DoPost(action string, args []string) (bool, error) {
 	if applications.OpenFile(action, f.OsPath) {
 		return true, nil
 	} else {
@@ -6,54 +6,89 @@
 package file
 
 import (
+	"context"
 	"log"
+	"slices"
 	"time"
 
 	"github.com/fsnotify/fsnotify"
 	"github.com/surlykke/refude/internal/applications"
+	"github.com/surlykke/refude/internal/config"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/xdg"
 )
 
-var FileMap = entity.MakeMap[string, *File]("/file/")
+var FileMap = entity.Register(entity.MakeMap[string, *File]("/file/"), entity.SearchOptions{MinTermLength: 3})
 
-func Run() {
-	FileMap.Serve()
-	var watchedDirs []string
+var subsystem = health.Get("file")
 
+// Runs until ctx is done
+func Run(ctx context.Context) {
+	FileMap.Serve()
+	subsystem.Gauge("files", FileMap.Len)
 	watcher, err := fsnotify.NewWatcher()
 	if err != nil {
 		panic(err)
 	}
 
-	for _, dir := range []string{xdg.Home, xdg.DesktopDir, xdg.DownloadDir, xdg.TemplatesDir, xdg.PublicshareDir, xdg.DocumentsDir, xdg.MusicDir, xdg.PicturesDir, xdg.VideosDir} {
-		if xdg.DirOrFileExists(dir) {
-			if err := watcher.Add(dir); err != nil {
-				log.Print("Not watching", dir, err)
+	var configChanges = make(chan []string)
+	go func() {
+		var subscription = config.Changes.Subscribe()
+		for {
+			if conf, err := subscription.NextContext(ctx); err != nil {
+				return
 			} else {
-				watchedDirs = append(watchedDirs, dir)
+				select {
+				case configChanges <- conf.FileDirs:
+				case <-ctx.Done():
+					return
+				}
 			}
 		}
-	}
+	}()
 
+	var configuredDirs = config.Get().FileDirs
+	var watchedDirs = watch(watcher, nil, configuredDirs)
 	var scanEv = make(chan struct{})
 	var scanScheduled = false
 	scanDirs(watchedDirs)
 	go func() {
 		var appSubscription = applications.AppMap.Events.Subscribe()
 		for {
-			appSubscription.Next()
-			scanEv <- struct{}{}
+			if _, err := appSubscription.NextContext(ctx); err != nil {
+				return
+			}
+			select {
+			case scanEv <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
 		}
 	}()
 
+	defer watcher.Close()
 	for {
 		select {
+		case <-ctx.Done():
+			return
+		case dirs := <-configChanges:
+			if !slices.Equal(dirs, configuredDirs) {
+				configuredDirs = dirs
+				watchedDirs = watch(watcher, watchedDirs, dirs)
+				scanDirs(watchedDirs)
+			}
 		case <-watcher.Events:
 			// We collect events for a second before scanning, as they can come in bursts
 			if !scanScheduled {
 				scanScheduled = true
-				go func() { time.Sleep(1 * time.Second); scanEv <- struct{}{} }()
+				go func() {
+					time.Sleep(1 * time.Second)
+					select {
+					case scanEv <- struct{}{}:
+					case <-ctx.Done():
+					}
+				}()
 			}
 		case <-scanEv:
 			scanScheduled = false
@@ -63,6 +98,31 @@ func Run() {
 
 }
 
+// Stops watching oldDirs and starts watching those of dirs that exist. Returns those
+func watch(watcher *fsnotify.Watcher, oldDirs []string, dirs []string) []string {
+	for _, dir := range oldDirs {
+		watcher.Remove(dir)
+	}
+	var watchedDirs = make([]string, 0, len(dirs))
+	var failed error
+	for _, dir := range dirs {
+		if xdg.DirOrFileExists(dir) {
+			if err := watcher.Add(dir); err != nil {
+				log.Print("Not watching", dir, err)
+				failed = err
+			} else {
+				watchedDirs = append(watchedDirs, dir)
+			}
+		}
+	}
+	if failed != nil {
+		subsystem.Degrade(failed)
+	} else {
+		subsystem.Recover()
+	}
+	return watchedDirs
+}
+
 func scanDirs(watchedDirs []string) {
 	var collected = make(map[string]*File, 50)
 	for _, dir := range watchedDirs {
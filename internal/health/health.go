@@ -0,0 +1,208 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package health
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"net/http"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/surlykke/refude/internal/lib/respond"
+)
+
+type State string
+
+const (
+	Running  State = "running"
+	Degraded State = "degraded" // Running, but something it needs is missing or failing
+	Failed   State = "failed"   // Not running
+)
+
+/*
+ * Health of one subsystem, eg. 'wayland' or 'notifications'. Subsystems report through this what would
+ * otherwise only go to the log.
+ */
+type Subsystem struct {
+	name     string
+	lock     sync.Mutex
+	state    State
+	started  time.Time
+	err      string
+	errTime  time.Time
+	counters map[string]uint64
+	gauges   map[string]func() int
+}
+
+var subsystems = make(map[string]*Subsystem)
+var subsystemsLock sync.Mutex
+
+// Returns the subsystem named name, making it if necessary
+func Get(name string) *Subsystem {
+	subsystemsLock.Lock()
+	defer subsystemsLock.Unlock()
+	if s, ok := subsystems[name]; ok {
+		return s
+	}
+	var s = &Subsystem{
+		name:     name,
+		state:    Running,
+		started:  time.Now(),
+		counters: make(map[string]uint64),
+		gauges:   make(map[string]func() int),
+	}
+	subsystems[name] = s
+	return s
+}
+
+/*
+ * Runs run in a goroutine as subsystem name. Should run panic, the subsystem is marked failed, and the rest
+ * of refude-server carries on. run is expected to keep running, so should it return, other than after Shutdown,
+ * the subsystem is marked failed too.
+ */
+func Go(name string, run func()) {
+	start(name, run, true)
+}
+
+// Like Go, but for subsystems that only set up, leaving the work to goroutines or handlers of their own. Here
+// run returning is fine
+func Setup(name string, run func()) {
+	start(name, run, false)
+}
+
+func start(name string, run func(), keepsRunning bool) {
+	var s = Get(name)
+	s.lock.Lock()
+	s.started = time.Now()
+	s.lock.Unlock()
+	go func() {
+		defer func() {
+			if r := recover(); r != nil {
+				log.Print(name, " failed: ", r, "\n", string(debug.Stack()))
+				s.Fail(fmt.Errorf("%v", r))
+			}
+		}()
+		run()
+		if keepsRunning && !shuttingDown.Load() {
+			log.Print(name, " exited")
+			s.Fail(errors.New("exited"))
+		}
+	}()
+}
+
+var shuttingDown atomic.Bool
+
+// From now on, subsystems stopping are not failing
+func Shutdown() {
+	shuttingDown.Store(true)
+}
+
+func (this *Subsystem) Fail(err error) {
+	this.setState(Failed, err)
+}
+
+func (this *Subsystem) Degrade(err error) {
+	this.setState(Degraded, err)
+}
+
+// Back to running after being degraded or failed. The last error is kept
+func (this *Subsystem) Recover() {
+	this.setState(Running, nil)
+}
+
+func (this *Subsystem) setState(state State, err error) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.state = state
+	if err != nil {
+		this.err, this.errTime = err.Error(), time.Now()
+	}
+}
+
+// Increments counter name
+func (this *Subsystem) Count(name string) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.counters[name]++
+}
+
+// Registers a counter whose value is computed when health is asked for, eg. number of windows
+func (this *Subsystem) Gauge(name string, value func() int) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.gauges[name] = value
+}
+
+type Report struct {
+	Name          string            `json:"name"`
+	State         State             `json:"state"`
+	Started       time.Time         `json:"started"`
+	LastError     string            `json:"lastError,omitempty"`
+	LastErrorTime *time.Time        `json:"lastErrorTime,omitempty"`
+	Counters      map[string]uint64 `json:"counters"`
+}
+
+func (this *Subsystem) report() Report {
+	this.lock.Lock()
+	var report = Report{
+		Name:      this.name,
+		State:     this.state,
+		Started:   this.started,
+		LastError: this.err,
+		Counters:  make(map[string]uint64, len(this.counters)+len(this.gauges)),
+	}
+	if this.err != "" {
+		var errTime = this.errTime
+		report.LastErrorTime = &errTime
+	}
+	maps.Copy(report.Counters, this.counters)
+	var gauges = maps.Clone(this.gauges)
+	this.lock.Unlock()
+
+	// Gauges may take locks of their own, so called without holding ours
+	for name, value := range gauges {
+		report.Counters[name] = uint64(max(0, value()))
+	}
+	return report
+}
+
+func Reports() []Report {
+	subsystemsLock.Lock()
+	var names = slices.Sorted(maps.Keys(subsystems))
+	var list = make([]*Subsystem, 0, len(names))
+	for _, name := range names {
+		list = append(list, subsystems[name])
+	}
+	subsystemsLock.Unlock()
+
+	var reports = make([]Report, 0, len(list))
+	for _, s := range list {
+		reports = append(reports, s.report())
+	}
+	return reports
+}
+
+func Run() {
+	http.HandleFunc("GET /health", func(w http.ResponseWriter, r *http.Request) {
+		respond.AsJson(w, Reports())
+	})
+	http.HandleFunc("GET /health/{name}", func(w http.ResponseWriter, r *http.Request) {
+		subsystemsLock.Lock()
+		var s, ok = subsystems[r.PathValue("name")]
+		subsystemsLock.Unlock()
+		if !ok {
+			respond.NotFound(w, r)
+		} else {
+			respond.AsJson(w, s.report())
+		}
+	})
+}
@@ -14,7 +14,9 @@ import (
 	"regexp"
 	"slices"
 	"sync"
+	"sync/atomic"
 
+	"github.com/surlykke/refude/internal/config"
 	"github.com/surlykke/refude/internal/lib/xdg"
 )
 
@@ -90,7 +92,10 @@ func collectThemeIcons(collected map[string][]IconPath) {
 
 func collectIconsFromTheme(themeId string) map[string][]IconPath {
 	var iconsFromTheme = make(map[string][]IconPath)
-	var theme, _ = ThemeMap.Get(themeId)
+	var theme, ok = ThemeMap.Get(themeId)
+	if !ok {
+		return iconsFromTheme
+	}
 	for _, basedir := range xdg.IconBasedirs {
 		for _, themeDir := range theme.Dirs {
 			var glob = basedir + "/" + themeId + "/" + themeDir.Path + "/*"
@@ -154,11 +159,16 @@ func determineSearchOrder() []string {
 	return searchOrder
 }
 
+// Set when a theme is selected through the api. Takes precedence over configuration and gtk settings
+var selectedThemeId atomic.Pointer[string]
+
 func determineDefaultThemeId() string {
 	var iconThemeDefPattern = regexp.MustCompile(`gtk-icon-theme-name=(\S+)`)
 
-	if defaultThemeId, ok := os.LookupEnv("REFUDE_ICON_THEME"); ok {
-		return defaultThemeId
+	if selected := selectedThemeId.Load(); selected != nil {
+		return *selected
+	} else if configured := config.Get().IconTheme; configured != "" {
+		return configured
 	} else {
 		for _, iniFile := range []string{
 			xdg.ConfigHome + "/gtk-4.0/settings.ini",
@@ -6,6 +6,7 @@
 package icons
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"math"
@@ -14,20 +15,54 @@ import (
 	"strings"
 	"sync"
 
+	"github.com/surlykke/refude/internal/config"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/image"
 	"github.com/surlykke/refude/internal/lib/respond"
 	"github.com/surlykke/refude/internal/lib/utils"
 )
 
-var ThemeMap = entity.MakeMap[string, *IconTheme]("/icontheme/")
+var ThemeMap = entity.Register(entity.MakeMap[string, *IconTheme]("/icontheme/"), entity.SearchOptions{Exclude: true})
+
+var subsystem = health.Get("icons")
 
 func Run() {
 	ThemeMap.Serve()
+	subsystem.Gauge("themes", ThemeMap.Len)
 	http.HandleFunc("GET /icon", GetHandler)
 
+	var configChanges = config.Changes.Subscribe()
+	var iconTheme = config.Get().IconTheme
 	collectThemes()
 	collectIcons()
+
+	go func() {
+		for {
+			if conf, err := configChanges.NextContext(context.Background()); err != nil {
+				return
+			} else if conf.IconTheme != iconTheme {
+				iconTheme = conf.IconTheme
+				collectThemes()
+				recollectIcons()
+			}
+		}
+	}()
+
+	// Icons are only collected here, so collections don't overlap
+	for range iconsStale {
+		collectIcons()
+	}
+}
+
+var iconsStale = make(chan struct{}, 1)
+
+// Makes Run collect icons again
+func recollectIcons() {
+	select {
+	case iconsStale <- struct{}{}:
+	default: // Already pending
+	}
 }
 
 func GetHandler(w http.ResponseWriter, r *http.Request) {
@@ -36,13 +71,13 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 	var size uint32 = 32
 	if sizeS != "" {
 		if err := utils.Convert(sizeS, &size); err != nil {
-			respond.UnprocessableEntity(w, err)
+			respond.UnprocessableEntity(w, r, err)
 			return
 		}
 	}
 	var iconFilePath = FindIcon(name, size)
 	if iconFilePath == "" {
-		respond.NotFound(w)
+		respond.NotFound(w, r)
 	} else {
 
 		var (
@@ -52,11 +87,11 @@ func GetHandler(w http.ResponseWriter, r *http.Request) {
 		)
 		if strings.HasSuffix(iconFilePath, ".xpm") {
 			if bytes = getPngFromXpm(iconFilePath); bytes == nil {
-				respond.NotFound(w)
+				respond.NotFound(w, r)
 				return
 			}
 		} else if bytes, err = os.ReadFile(iconFilePath); err != nil {
-			respond.NotFound(w)
+			respond.NotFound(w, r)
 			return
 		}
 
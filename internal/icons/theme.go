@@ -6,6 +6,8 @@
 package icons
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"path/filepath"
 	"slices"
@@ -23,6 +25,7 @@ type IconTheme struct {
 	Comment  string
 	Inherits []string
 	Dirs     []IconDir
+	Selected bool
 }
 
 type IconDir struct {
@@ -36,12 +39,53 @@ func collectThemes() {
 	var mapOfThemes = readThemes(xdg.IconBasedirs)
 	if _, ok := mapOfThemes["hicolor"]; !ok {
 		log.Print("Found no hicolor theme - unable to serve icons")
+		subsystem.Degrade(errors.New("found no hicolor theme"))
 		return
 	}
 
+	if theme, ok := mapOfThemes[determineDefaultThemeId()]; ok {
+		theme.Selected = true
+	}
+
 	ThemeMap.ReplaceAll(mapOfThemes)
 }
 
+// Patching Selected to true makes this the theme icons are served from. Setting it to false
+// on the selected theme reverts to the theme configured for gtk.
+func (this *IconTheme) DoPatch(patch map[string]json.RawMessage) (entity.Servable, error) {
+	var copy = *this
+	if err := entity.CheckPatchFields(patch, "Selected"); err != nil {
+		return nil, err
+	} else if ok, err := entity.PatchField(patch, "Selected", &copy.Selected); err != nil || !ok {
+		return &copy, err
+	} else if copy.Selected == this.Selected {
+		return &copy, nil
+	}
+
+	if copy.Selected {
+		selectedThemeId.Store(&this.Id)
+	} else {
+		selectedThemeId.Store(nil)
+	}
+	// When deselecting, the theme reverted to may be this one
+	var selectedId = determineDefaultThemeId()
+	copy.Selected = copy.Id == selectedId
+	markSelected(selectedId, this.Id)
+	recollectIcons()
+	return &copy, nil
+}
+
+// Marks the theme with id selectedId as Selected, and others not, except the theme with id skip, which is left alone
+func markSelected(selectedId string, skip string) {
+	for _, theme := range ThemeMap.GetAll() {
+		if theme.Id != skip && theme.Selected != (theme.Id == selectedId) {
+			var other = *theme
+			other.Selected = !other.Selected
+			ThemeMap.Put(other.Id, &other)
+		}
+	}
+}
+
 func readThemes(basedirs []string) map[string]*IconTheme {
 	var themeMap = make(map[string]*IconTheme)
 
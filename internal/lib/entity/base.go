@@ -6,6 +6,7 @@
 package entity
 
 import (
+	"encoding/json"
 	"strings"
 
 	"github.com/surlykke/refude/internal/lib/translate"
@@ -114,10 +115,28 @@ const (
 
 // -------------- Serve -------------------------
 
+// DoPost is given the action id (which may be "") and the arguments posted, if any.
+// It should return false if the action is unknown.
 type Postable interface {
-	DoPost(string) (bool, error)
+	DoPost(action string, args []string) (bool, error)
+}
+
+// Returned by DoPost when the arguments posted are not acceptable. Answered with 'unprocessable entity'
+type ArgumentError struct {
+	Problem string
+}
+
+func (this ArgumentError) Error() string {
+	return "arguments: " + this.Problem
 }
 
 type Deleteable interface {
 	DoDelete() error
 }
+
+// DoPatch is given a json merge-patch (RFC 7396), decoded one level deep.
+// It should return the patched entity, which will replace the current one in
+// its map. Return a PatchError if the patch is not acceptable.
+type Patchable interface {
+	DoPatch(map[string]json.RawMessage) (Servable, error)
+}
@@ -7,37 +7,75 @@ package entity
 
 import (
 	"cmp"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"mime"
 	"net/http"
+	"reflect"
+	"slices"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/surlykke/refude/internal/lib/respond"
 	"github.com/surlykke/refude/internal/lib/utils"
 	"github.com/surlykke/refude/pkg/pubsub"
 )
 
+type Op string
+
+const (
+	OpPut    Op = "put"    // Entity at Path added or changed
+	OpRemove Op = "remove" // Entity at Path removed
+	OpReset  Op = "reset"  // Map replaced wholesale, refetch the collection at Path
+)
+
 type Event struct {
-	Event string
-	Data  string
+	Event  string   `json:"-"` // Prefix of the map publishing
+	Op     Op       `json:"op"`
+	Path   string   `json:"path"`
+	Entity Servable `json:"data,omitempty"` // The new entity, on OpPut
 }
 
+// Each modification of the map increments version. The entity put (if any) is tagged with that
+// version. The version of the map as a whole serves as etag for the collection, the
+// version of each entity as etag for that.
+// index holds what search needs of each entity, see searchindex.go
 type EntityMap[K cmp.Ordered, V Servable] struct {
-	m      map[K]V
-	lock   sync.Mutex
-	Prefix string
-	Events *pubsub.Publisher[Event]
+	m        map[K]V
+	versions map[K]uint64
+	index    map[K]*SearchEntry
+	version  uint64
+	lock     sync.Mutex
+	Prefix   string
+	Events   *pubsub.Publisher[Event]
 }
 
 func MakeMap[K cmp.Ordered, V Servable](prefix string) *EntityMap[K, V] {
 	var m = &EntityMap[K, V]{
-		m:      make(map[K]V),
-		Prefix: prefix,
-		Events: pubsub.MakePublisher[Event](),
+		m:        make(map[K]V),
+		versions: make(map[K]uint64),
+		index:    make(map[K]*SearchEntry),
+		Prefix:   prefix,
+		Events:   pubsub.MakePublisher[Event](),
 	}
 
 	return m
 }
 
+/*
+ * For maps that may change in bursts, eg. window titles or battery properties. Events are held back for window,
+ * and then only the latest for each path is published. Returns the map itself, so it can be used as:
+ *
+ *	var WindowMap = entity.Register(entity.MakeMap[uint64, *WaylandWindow]("/window/").Coalesce(50*time.Millisecond), ...)
+ */
+func (this *EntityMap[K, V]) Coalesce(window time.Duration) *EntityMap[K, V] {
+	this.Events.Coalesce(window, func(e Event) string { return e.Path })
+	return this
+}
+
 func (this *EntityMap[K, V]) Get(k K) (V, bool) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
@@ -45,32 +83,72 @@ func (this *EntityMap[K, V]) Get(k K) (V, bool) {
 	return v, ok
 }
 
+func (this *EntityMap[K, V]) getVersioned(k K) (V, uint64, bool) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	v, ok := this.m[k]
+	return v, this.versions[k], ok
+}
+
 func (this *EntityMap[K, V]) Put(k K, v V) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	this.put(k, v)
-	this.publishWithId(k)
+	this.publishPut(k, v)
+}
+
+// Puts v only if the entity at k is still the one tagged with version, so a change made meanwhile isn't lost
+func (this *EntityMap[K, V]) putIfVersion(k K, v V, version uint64) bool {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if current, ok := this.versions[k]; !ok || current != version {
+		return false
+	}
+	this.put(k, v)
+	this.publishPut(k, v)
+	return true
 }
 
 func (this *EntityMap[K, V]) Remove(k K) (V, bool) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
-	this.publishWithId(k)
-	return this.remove(k)
+	v, ok := this.remove(k)
+	if ok {
+		this.publishRemove(k)
+	}
+	return v, ok
 }
 
 func (this *EntityMap[K, V]) Replace(newVals map[K]V, remove func(V) bool) {
+	this.replace(newVals, remove, true)
+}
+
+// As Replace, but without publishing events. For transient entities, like search results computed on demand,
+// which should be gettable, but are of no interest to watchers
+func (this *EntityMap[K, V]) ReplaceUnpublished(newVals map[K]V, remove func(V) bool) {
+	this.replace(newVals, remove, false)
+}
+
+func (this *EntityMap[K, V]) replace(newVals map[K]V, remove func(V) bool, publish bool) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	for k, v := range this.m {
 		if remove(v) {
 			delete(this.m, k)
+			delete(this.versions, k)
+			delete(this.index, k)
+			if _, ok := newVals[k]; !ok && publish {
+				this.publishRemove(k)
+			}
 		}
 	}
+	this.version++
 	for k, v := range newVals {
 		this.put(k, v)
+		if publish {
+			this.publishPut(k, v)
+		}
 	}
-	this.publish()
 }
 
 func (this *EntityMap[K, V]) ReplaceAll(newSet map[K]V) {
@@ -80,28 +158,47 @@ func (this *EntityMap[K, V]) ReplaceAll(newSet map[K]V) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	this.m = newSet
-	this.publish()
+	this.version++
+	this.versions = make(map[K]uint64, len(newSet))
+	var index = make(map[K]*SearchEntry, len(newSet))
+	for id, v := range newSet {
+		this.versions[id] = this.version
+		index[id] = makeSearchEntry(v, this.index[id])
+	}
+	this.index = index
+	this.publishReset()
+}
+
+func (this *EntityMap[K, V]) Len() int {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	return len(this.m)
 }
 
 func (this *EntityMap[K, V]) GetAll() []V {
+	var list, _ = this.getAllVersioned()
+	return list
+}
+
+func (this *EntityMap[K, V]) getAllVersioned() ([]V, uint64) {
 	this.lock.Lock()
 	defer this.lock.Unlock()
 	var list = make([]V, 0, len(this.m))
 	for _, v := range this.m {
 		list = append(list, v)
 	}
-	return list
+	return list, this.version
 }
 
-func (this *EntityMap[K, V]) GetForSearch() []Base {
-	var bases = make([]Base, 0, len(this.m))
-	for _, v := range this.GetAll() {
-		if v.OmitFromSearch() {
-			continue
-		}
-		bases = append(bases, *v.GetBase())
+// Whether an entity is omitted may depend on time, so that is checked here, rather than when it is put
+func (this *EntityMap[K, V]) GetSearchEntries() []*SearchEntry {
+	this.lock.Lock()
+	var entries = make([]*SearchEntry, 0, len(this.index))
+	for _, e := range this.index {
+		entries = append(entries, e)
 	}
-	return bases
+	this.lock.Unlock()
+	return slices.DeleteFunc(entries, func(e *SearchEntry) bool { return e.Entity.OmitFromSearch() })
 }
 
 func (this *EntityMap[K, V]) GetPaths() []string {
@@ -114,60 +211,122 @@ func (this *EntityMap[K, V]) GetPaths() []string {
 	return paths
 }
 
+func (this *EntityMap[K, V]) GetPrefix() string {
+	return this.Prefix
+}
+
+func (this *EntityMap[K, V]) GetEvents() *pubsub.Publisher[Event] {
+	return this.Events
+}
+
+func (this *EntityMap[K, V]) GetEntityType() reflect.Type {
+	return reflect.TypeFor[V]()
+}
+
 func (this *EntityMap[K, V]) put(k K, v V) {
 	v.GetBase().SetPath(fmt.Sprintf("%s%v", this.Prefix, k))
+	this.version++
 	this.m[k] = v
+	this.versions[k] = this.version
+	this.index[k] = makeSearchEntry(v, this.index[k])
 }
 
 func (this *EntityMap[K, V]) remove(k K) (V, bool) {
 	v, ok := this.m[k]
 	if ok {
 		delete(this.m, k)
+		delete(this.versions, k)
+		delete(this.index, k)
+		this.version++
 	}
 	return v, ok
 }
 
-func (this *EntityMap[K, V]) publishWithId(id K) {
-	this.Events.Publish(Event{Event: this.Prefix, Data: fmt.Sprintf("%v", id)})
+func (this *EntityMap[K, V]) publishPut(k K, v V) {
+	this.Events.Publish(Event{Event: this.Prefix, Op: OpPut, Path: fmt.Sprintf("%s%v", this.Prefix, k), Entity: v})
+}
+
+func (this *EntityMap[K, V]) publishRemove(k K) {
+	this.Events.Publish(Event{Event: this.Prefix, Op: OpRemove, Path: fmt.Sprintf("%s%v", this.Prefix, k)})
 }
 
-func (this *EntityMap[K, V]) publish() {
-	this.Events.Publish(Event{Event: this.Prefix, Data: ""})
+func (this *EntityMap[K, V]) publishReset() {
+	this.Events.Publish(Event{Event: this.Prefix, Op: OpReset, Path: this.Prefix})
 }
 
 func (this *EntityMap[K, V]) Serve() {
 	http.HandleFunc("GET "+this.Prefix+"{id...}", func(w http.ResponseWriter, r *http.Request) {
 		var id = r.PathValue("id")
 		if id == "" {
-			respond.AsJson(w, this.GetAll())
-		} else if v, ok := this.GetByStr(id); !ok {
-			respond.NotFound(w)
+			this.serveCollection(w, r)
+		} else if v, version, ok := this.getVersionedByStr(id); !ok {
+			respond.NotFound(w, r)
+		} else if etag := makeETag(version); noneMatchFails(r, etag) {
+			w.Header().Set("ETag", etag)
+			respond.NotModified(w)
 		} else {
+			w.Header().Set("ETag", etag)
 			respond.AsJson(w, v)
 		}
 	})
 	http.HandleFunc("POST "+this.Prefix+"{id...}", func(w http.ResponseWriter, r *http.Request) {
-		if v, ok := this.GetByStr(r.PathValue("id")); !ok {
-			respond.NotFound(w)
+		if v, version, ok := this.getVersionedByStr(r.PathValue("id")); !ok {
+			respond.NotFound(w, r)
 		} else if postable, ok := any(v).(Postable); !ok {
-			respond.NotAllowed(w)
+			respond.NotAllowed(w, r)
+		} else if matchFails(r, makeETag(version)) {
+			respond.PreconditionFailed(w, r)
+		} else if args, err := postedArguments(r); err != nil {
+			respond.UnprocessableEntity(w, r, err)
+		} else if ok, err := postable.DoPost(utils.QueryParam(r, "action"), args); errors.As(err, &ArgumentError{}) {
+			respond.UnprocessableEntity(w, r, err)
+		} else if err != nil {
+			respond.ServerError(w, r, err)
+		} else if !ok {
+			respond.NotFound(w, r)
 		} else {
-			if ok, err := postable.DoPost(utils.QueryParam(r, "action")); err != nil {
-				respond.ServerError(w, err)
-			} else if !ok {
-				respond.NotFound(w)
-			} else {
-				respond.Accepted(w)
-			}
+			Activations.Publish(Activation{Path: v.GetBase().Path, Term: utils.QueryParam(r, "term")})
+			respond.Accepted(w)
 		}
 	})
 	http.HandleFunc("DELETE "+this.Prefix+"{id...}", func(w http.ResponseWriter, r *http.Request) {
-		if v, ok := this.GetByStr(r.PathValue("id")); !ok {
-			respond.NotFound(w)
+		if v, version, ok := this.getVersionedByStr(r.PathValue("id")); !ok {
+			respond.NotFound(w, r)
 		} else if deleteable, ok := any(v).(Deleteable); !ok {
-			respond.NotAllowed(w)
+			respond.NotAllowed(w, r)
+		} else if matchFails(r, makeETag(version)) {
+			respond.PreconditionFailed(w, r)
 		} else if err := deleteable.DoDelete(); err != nil {
-			respond.ServerError(w, err)
+			respond.ServerError(w, r, err)
+		} else {
+			respond.Accepted(w)
+		}
+	})
+	http.HandleFunc("PATCH "+this.Prefix+"{id...}", func(w http.ResponseWriter, r *http.Request) {
+		var id K
+		var patch map[string]json.RawMessage
+		if err := utils.Convert(r.PathValue("id"), &id); err != nil {
+			respond.NotFound(w, r)
+		} else if v, version, ok := this.getVersioned(id); !ok {
+			respond.NotFound(w, r)
+		} else if patchable, ok := any(v).(Patchable); !ok {
+			respond.NotAllowed(w, r)
+		} else if matchFails(r, makeETag(version)) {
+			respond.PreconditionFailed(w, r)
+		} else if err := json.NewDecoder(r.Body).Decode(&patch); err != nil {
+			respond.UnprocessableEntity(w, r, err)
+		} else if patch == nil {
+			respond.UnprocessableEntity(w, r, errors.New("merge-patch must be a json object"))
+		} else if patched, err := patchable.DoPatch(patch); err != nil {
+			if errors.As(err, &PatchError{}) {
+				respond.UnprocessableEntity(w, r, err)
+			} else {
+				respond.ServerError(w, r, err)
+			}
+		} else if newV, ok := patched.(V); !ok {
+			respond.ServerError(w, r, fmt.Errorf("patch of %s%v yielded %T", this.Prefix, id, patched))
+		} else if !this.putIfVersion(id, newV, version) {
+			respond.PreconditionFailed(w, r)
 		} else {
 			respond.Accepted(w)
 		}
@@ -175,12 +334,72 @@ func (this *EntityMap[K, V]) Serve() {
 
 }
 
+func (this *EntityMap[K, V]) serveCollection(w http.ResponseWriter, r *http.Request) {
+	if cq, err := parseCollectionQuery(r); err != nil {
+		respond.UnprocessableEntity(w, r, err)
+	} else {
+		var all, version = this.getAllVersioned()
+		var etag = makeETag(version)
+		w.Header().Set("ETag", etag)
+		if noneMatchFails(r, etag) {
+			respond.NotModified(w)
+			return
+		}
+		var list, total = applyCollectionQuery(cq, all)
+		w.Header().Set("X-Total-Count", strconv.Itoa(total))
+		if len(cq.fields) == 0 {
+			respond.AsJson(w, list)
+		} else if selected, err := selectFields(cq.fields, list); err != nil {
+			respond.ServerError(w, r, err)
+		} else {
+			respond.AsJson(w, selected)
+		}
+	}
+}
+
+/*
+ * Arguments to an action may be posted as
+ *   - json: a list of strings or a single string
+ *   - a form: each argument in a field named 'arg'
+ * An empty body means no arguments
+ */
+func postedArguments(r *http.Request) ([]string, error) {
+	var contentType, _, _ = mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch contentType {
+	case "application/x-www-form-urlencoded", "multipart/form-data":
+		if err := r.ParseMultipartForm(1 << 20); err != nil && err != http.ErrNotMultipart {
+			return nil, err
+		}
+		return r.PostForm["arg"], nil
+	default:
+		var raw json.RawMessage
+		var args []string
+		var arg string
+		if err := json.NewDecoder(r.Body).Decode(&raw); err == io.EOF {
+			return nil, nil
+		} else if err != nil {
+			return nil, err
+		} else if err := json.Unmarshal(raw, &args); err == nil {
+			return args, nil
+		} else if err := json.Unmarshal(raw, &arg); err == nil {
+			return []string{arg}, nil
+		} else {
+			return nil, errors.New("arguments must be given as a json string or list of strings")
+		}
+	}
+}
+
 func (this *EntityMap[K, V]) GetByStr(idStr string) (V, bool) {
+	var v, _, ok = this.getVersionedByStr(idStr)
+	return v, ok
+}
+
+func (this *EntityMap[K, V]) getVersionedByStr(idStr string) (V, uint64, bool) {
 	var id K
 	if err := utils.Convert(idStr, &id); err != nil {
 		var zeroval V
-		return zeroval, false
+		return zeroval, 0, false
 	} else {
-		return this.Get(id)
+		return this.getVersioned(id)
 	}
 }
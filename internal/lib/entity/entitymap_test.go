@@ -0,0 +1,37 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"testing"
+)
+
+func TestPutIfVersion(t *testing.T) {
+	var m = MakeMap[string, *Base]("/test/")
+	m.Put("a", MakeBase("A", "", "", "Test"))
+	var _, version, _ = m.getVersioned("a")
+
+	m.Put("a", MakeBase("A changed meanwhile", "", "", "Test"))
+	if m.putIfVersion("a", MakeBase("A patched", "", "", "Test"), version) {
+		t.Error("Expected put refused, as a was changed after version")
+	}
+	if a, _ := m.Get("a"); a.Title != "A changed meanwhile" {
+		t.Errorf("Expected change kept, got '%s'", a.Title)
+	}
+
+	_, version, _ = m.getVersioned("a")
+	if !m.putIfVersion("a", MakeBase("A patched", "", "", "Test"), version) {
+		t.Error("Expected put done")
+	}
+
+	m.Remove("a")
+	if m.putIfVersion("a", MakeBase("A patched again", "", "", "Test"), version) {
+		t.Error("Expected put refused, as a was removed")
+	}
+	if _, ok := m.Get("a"); ok {
+		t.Error("Expected a to stay removed")
+	}
+}
@@ -0,0 +1,52 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Versions restart on each run of refude-server, so we tag them with the start time,
+// lest a client holding an etag from a previous run gets a false match.
+var etagEpoch = strconv.FormatInt(time.Now().UnixNano(), 36)
+
+func makeETag(version uint64) string {
+	return fmt.Sprintf(`"%s-%d"`, etagEpoch, version)
+}
+
+// If-None-Match uses weak comparison, so 'W/' prefixes are ignored
+func noneMatchFails(r *http.Request, etag string) bool {
+	if header := r.Header.Get("If-None-Match"); header == "" {
+		return false
+	} else if strings.TrimSpace(header) == "*" {
+		return true
+	} else {
+		for _, tag := range strings.Split(header, ",") {
+			if strings.TrimPrefix(strings.TrimSpace(tag), "W/") == etag {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// If-Match uses strong comparison, so a weak etag never matches
+func matchFails(r *http.Request, etag string) bool {
+	if header := r.Header.Get("If-Match"); header == "" || strings.TrimSpace(header) == "*" {
+		return false
+	} else {
+		for _, tag := range strings.Split(header, ",") {
+			if strings.TrimSpace(tag) == etag {
+				return false
+			}
+		}
+		return true
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+type PatchError struct {
+	Field   string
+	Problem string
+}
+
+func (this PatchError) Error() string {
+	return fmt.Sprintf("%s: %s", this.Field, this.Problem)
+}
+
+// Checks that the patch only touches the given fields
+func CheckPatchFields(patch map[string]json.RawMessage, allowed ...string) error {
+	for field := range patch {
+		if !slices.Contains(allowed, field) {
+			return PatchError{Field: field, Problem: "cannot be patched"}
+		}
+	}
+	return nil
+}
+
+// If field is present in patch, unmarshal it into dest and return true.
+// A null value (which in merge-patch means 'remove') is rejected, as none of
+// our fields are optional.
+func PatchField[T any](patch map[string]json.RawMessage, field string, dest *T) (bool, error) {
+	if raw, ok := patch[field]; !ok {
+		return false, nil
+	} else if string(raw) == "null" {
+		return false, PatchError{Field: field, Problem: "cannot be removed"}
+	} else if err := json.Unmarshal(raw, dest); err != nil {
+		return false, PatchError{Field: field, Problem: err.Error()}
+	} else {
+		return true, nil
+	}
+}
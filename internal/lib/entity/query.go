@@ -0,0 +1,138 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/surlykke/refude/internal/lib/utils"
+)
+
+/*
+ * Query parameters understood when getting a collection, eg. '/application/':
+ *
+ *   type=<kind>          only entities of that type, eg. 'Application'. May be repeated
+ *   q=<text>             only entities with text in title, subtitle or a keyword (case insensitive)
+ *   sort=<key>           title, subtitle, type or path. Prefix with '-' for descending. Default is path
+ *   offset=<n>, limit=<n> paging. Total number of matches is given in header X-Total-Count
+ *   fields=<f1>,<f2>..   only these json fields of each entity, eg. 'title,path,icon'
+ */
+type collectionQuery struct {
+	kinds  []string
+	q      string
+	sortBy string
+	desc   bool
+	offset int
+	limit  int
+	fields []string
+}
+
+var sortKeys = map[string]func(*Base) string{
+	"title":    func(b *Base) string { return strings.ToLower(b.Title) },
+	"subtitle": func(b *Base) string { return strings.ToLower(b.Subtitle) },
+	"type":     func(b *Base) string { return b.Kind },
+	"path":     func(b *Base) string { return b.Path },
+}
+
+func parseCollectionQuery(r *http.Request) (collectionQuery, error) {
+	var cq = collectionQuery{
+		kinds:  r.URL.Query()["type"],
+		q:      strings.ToLower(utils.QueryParam(r, "q")),
+		sortBy: utils.QueryParam(r, "sort"),
+		limit:  -1,
+		fields: utils.Split(utils.QueryParam(r, "fields"), ","),
+	}
+
+	if strings.HasPrefix(cq.sortBy, "-") {
+		cq.sortBy, cq.desc = cq.sortBy[1:], true
+	}
+	if cq.sortBy == "" {
+		cq.sortBy = "path"
+	} else if _, ok := sortKeys[cq.sortBy]; !ok {
+		return cq, errors.New("sort must be one of title, subtitle, type or path")
+	}
+
+	var err error
+	if cq.offset, err = nonNegativeParam(r, "offset", 0); err != nil {
+		return cq, err
+	} else if cq.limit, err = nonNegativeParam(r, "limit", -1); err != nil {
+		return cq, err
+	}
+	return cq, nil
+}
+
+func nonNegativeParam(r *http.Request, name string, fallback int) (int, error) {
+	if s := utils.QueryParam(r, name); s == "" {
+		return fallback, nil
+	} else if n, err := strconv.Atoi(s); err != nil || n < 0 {
+		return 0, errors.New(name + " must be a non-negative integer")
+	} else {
+		return n, nil
+	}
+}
+
+func (this collectionQuery) accepts(b *Base) bool {
+	if len(this.kinds) > 0 && !slices.Contains(this.kinds, b.Kind) {
+		return false
+	} else if this.q == "" {
+		return true
+	} else if strings.Contains(strings.ToLower(b.Title), this.q) || strings.Contains(strings.ToLower(b.Subtitle), this.q) {
+		return true
+	} else {
+		return slices.ContainsFunc(b.Keywords, func(k string) bool { return strings.Contains(strings.ToLower(k), this.q) })
+	}
+}
+
+// Filters, sorts and pages list. Returns the resulting list and the number of entities
+// that passed the filter
+func applyCollectionQuery[V Servable](cq collectionQuery, list []V) ([]V, int) {
+	list = slices.DeleteFunc(list, func(v V) bool { return !cq.accepts(v.GetBase()) })
+	var key = sortKeys[cq.sortBy]
+	slices.SortFunc(list, func(v1, v2 V) int {
+		var res = strings.Compare(key(v1.GetBase()), key(v2.GetBase()))
+		if res == 0 {
+			// Not significant, just to make the sort reproducible
+			res = strings.Compare(v1.GetBase().Path, v2.GetBase().Path)
+		}
+		if cq.desc {
+			res = -res
+		}
+		return res
+	})
+
+	var total = len(list)
+	list = list[min(cq.offset, total):]
+	if cq.limit > -1 && cq.limit < len(list) {
+		list = list[:cq.limit]
+	}
+	return list, total
+}
+
+// Reduces each element of list to the json fields asked for
+func selectFields[V Servable](fields []string, list []V) ([]map[string]json.RawMessage, error) {
+	var result = make([]map[string]json.RawMessage, 0, len(list))
+	for _, v := range list {
+		var all, selected map[string]json.RawMessage
+		if bytes, err := json.Marshal(v); err != nil {
+			return nil, err
+		} else if err := json.Unmarshal(bytes, &all); err != nil {
+			return nil, err
+		}
+		selected = make(map[string]json.RawMessage, len(fields))
+		for _, field := range fields {
+			if val, ok := all[field]; ok {
+				selected[field] = val
+			}
+		}
+		result = append(result, selected)
+	}
+	return result, nil
+}
@@ -0,0 +1,55 @@
+package entity
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+type testEntity struct {
+	Base
+}
+
+func makeTestEntity(title, kind, path string) *testEntity {
+	var e = &testEntity{Base: *MakeBase(title, "", "", kind)}
+	e.SetPath(path)
+	return e
+}
+
+func TestCollectionQuery(t *testing.T) {
+	var list = []*testEntity{
+		makeTestEntity("Firefox", "Application", "/application/firefox"),
+		makeTestEntity("Files", "Application", "/application/files"),
+		makeTestEntity("firefox.png", "File", "/file/firefox.png"),
+		makeTestEntity("Gimp", "Application", "/application/gimp"),
+	}
+
+	var r = httptest.NewRequest("GET", "/x/?type=Application&q=fi&sort=-title&limit=1&offset=1", nil)
+	cq, err := parseCollectionQuery(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var result, total = applyCollectionQuery(cq, list)
+	if total != 2 {
+		t.Errorf("Expected 2 matches, got %d", total)
+	}
+	if len(result) != 1 || result[0].Title != "Files" {
+		t.Errorf("Expected [Files], got %v", result)
+	}
+
+	if _, err := parseCollectionQuery(httptest.NewRequest("GET", "/x/?sort=size", nil)); err == nil {
+		t.Error("Expected error on unknown sort key")
+	}
+	if _, err := parseCollectionQuery(httptest.NewRequest("GET", "/x/?limit=-1", nil)); err == nil {
+		t.Error("Expected error on negative limit")
+	}
+}
+
+func TestSelectFields(t *testing.T) {
+	var selected, err = selectFields([]string{"title", "path"}, []*testEntity{makeTestEntity("Gimp", "Application", "/application/gimp")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(selected[0]) != 2 || string(selected[0]["title"]) != `"Gimp"` || string(selected[0]["path"]) != `"/application/gimp"` {
+		t.Errorf("Unexpected selection: %v", selected[0])
+	}
+}
@@ -0,0 +1,78 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"reflect"
+	"strings"
+	"sync"
+
+	"github.com/surlykke/refude/pkg/pubsub"
+)
+
+// What completion, search, watch and schema need from an EntityMap
+type Collection interface {
+	GetPrefix() string
+	GetPaths() []string
+	GetSearchEntries() []*SearchEntry
+	GetEvents() *pubsub.Publisher[Event]
+	GetEntityType() reflect.Type
+}
+
+// May be implemented by a Collection that computes some search results on demand, eg. by asking a plugin.
+// The Bases returned should be gettable from the collection, but not returned by GetSearchEntries.
+type DynamicSearcher interface {
+	SearchFor(term string) []Base
+}
+
+// An entity posted to. Term is what the user had searched for to find it, if the client tells (with query
+// parameter term)
+type Activation struct {
+	Path string
+	Term string
+}
+
+var Activations = pubsub.MakePublisher[Activation]()
+
+type SearchOptions struct {
+	Exclude       bool // Never in search results, but still found by SearchByPath
+	MinTermLength int  // Only searched when the term has at least this many runes
+}
+
+type Registration struct {
+	Collection
+	SearchOptions
+}
+
+var registry []Registration
+var registryLock sync.Mutex
+
+// Registers c, so that it takes part in completion, search and watch. Returns c, so it may be used
+// where c is declared, eg:
+//
+//	var AppMap = entity.Register(entity.MakeMap[string, *DesktopApplication]("/application/"), entity.SearchOptions{MinTermLength: 1})
+func Register[C Collection](c C, opts SearchOptions) C {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	registry = append(registry, Registration{Collection: c, SearchOptions: opts})
+	return c
+}
+
+func Registered() []Registration {
+	registryLock.Lock()
+	defer registryLock.Unlock()
+	return append([]Registration{}, registry...)
+}
+
+// The registration whose prefix path starts with
+func RegisteredFor(path string) (Registration, bool) {
+	for _, reg := range Registered() {
+		if strings.HasPrefix(path, reg.GetPrefix()) {
+			return reg, true
+		}
+	}
+	return Registration{}, false
+}
@@ -0,0 +1,50 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"slices"
+
+	"github.com/surlykke/refude/internal/lib/fold"
+)
+
+/*
+ * An EntityMap keeps, for each entity, a copy of its base, with title and keywords folded for search, so a search
+ * need not fold them again on each keystroke, nor read the entity without the map's lock. The entry is made when the
+ * entity is put, reusing the folds of the entry it replaces if title and keywords are the same.
+ *
+ * Hence an entity must be put again when it changes. Changes made in place are not seen by search.
+ */
+type SearchEntry struct {
+	Entity         Servable
+	Base           Base
+	folded         fold.Folded
+	keywordsFolded []fold.Folded
+}
+
+func makeSearchEntry(v Servable, old *SearchEntry) *SearchEntry {
+	var e = &SearchEntry{Entity: v, Base: *v.GetBase()}
+	e.Base.Keywords = slices.Clone(e.Base.Keywords)
+	if old != nil && old.Base.Title == e.Base.Title && slices.Equal(old.Base.Keywords, e.Base.Keywords) {
+		e.folded, e.keywordsFolded = old.folded, old.keywordsFolded
+	} else {
+		e.folded, e.keywordsFolded = foldAll(e.Base.Title, e.Base.Keywords)
+	}
+	return e
+}
+
+// Title and keywords of the entity, folded
+func (this *SearchEntry) Folds() (fold.Folded, []fold.Folded) {
+	return this.folded, this.keywordsFolded
+}
+
+func foldAll(title string, keywords []string) (fold.Folded, []fold.Folded) {
+	var keywordsFolded = make([]fold.Folded, len(keywords))
+	for i, keyword := range keywords {
+		keywordsFolded[i] = fold.Fold(keyword)
+	}
+	return fold.Fold(title), keywordsFolded
+}
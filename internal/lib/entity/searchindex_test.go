@@ -0,0 +1,46 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package entity
+
+import (
+	"testing"
+)
+
+func TestSearchIndex(t *testing.T) {
+	var m = MakeMap[string, *Base]("/test/")
+	m.Put("a", MakeBase("Café", "", "", "Test", "coffee"))
+	m.Put("b", MakeBase("Bar", "", "", "Test"))
+
+	var entries = m.GetSearchEntries()
+	if len(entries) != 2 {
+		t.Fatalf("Expected 2 entries, got %d", len(entries))
+	}
+	var first = m.index["a"]
+	if title, keywords := first.Folds(); string(title.Runes) != "cafe" || len(keywords) != 1 || string(keywords[0].Runes) != "coffee" {
+		t.Errorf("Unexpected folds: %s, %v", string(title.Runes), keywords)
+	}
+
+	// Put again, unchanged, the folds are reused
+	m.Put("a", MakeBase("Café", "Other subtitle", "", "Test", "coffee"))
+	if &m.index["a"].folded.Runes[0] != &first.folded.Runes[0] {
+		t.Error("Expected folds reused")
+	}
+
+	m.Remove("a")
+	if len(m.GetSearchEntries()) != 1 || m.index["a"] != nil {
+		t.Error("Expected 'a' removed from index")
+	}
+
+	m.Replace(map[string]*Base{"c": MakeBase("C", "", "", "Test")}, func(*Base) bool { return true })
+	if len(m.index) != 1 || m.index["c"] == nil {
+		t.Errorf("Expected only 'c' in index, got %v", m.index)
+	}
+
+	m.ReplaceAll(map[string]*Base{"d": MakeBase("D", "", "", "Test"), "e": MakeBase("E", "", "", "Test")})
+	if len(m.index) != 2 || m.index["d"] == nil || m.index["e"] == nil {
+		t.Errorf("Expected 'd' and 'e' in index, got %v", m.index)
+	}
+}
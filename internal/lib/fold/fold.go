@@ -0,0 +1,96 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package fold
+
+import (
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+/*
+ * Texts and search terms are folded before matching, so that 'cafe' matches 'Café', 'ae' matches 'Æble' and 'fi' matches
+ * 'ﬁle': Runes are lowercased and decomposed to their compatibility form (NFKD), and combining marks are dropped.
+ * Letters that don't decompose, but are commonly written with plain letters, are replaced as given in expansions.
+ */
+var expansions = map[rune]string{
+	'æ': "ae",
+	'ø': "o",
+	'œ': "oe",
+	'ß': "ss",
+	'ð': "d",
+	'þ': "th",
+	'ł': "l",
+	'đ': "d",
+	'ħ': "h",
+	'ı': "i",
+}
+
+type Folded struct {
+	Runes    []rune
+	Origin   []int  // For each rune in Runes, the index of the rune in the original text it came from
+	Boundary []bool // For each rune in Runes, whether it is the first from a rune that starts a word or camelCase hump
+}
+
+func Fold(text string) Folded {
+	var original = []rune(text)
+	var f = Folded{
+		Runes:    make([]rune, 0, len(original)),
+		Origin:   make([]int, 0, len(original)),
+		Boundary: make([]bool, 0, len(original)),
+	}
+	var add = func(r rune, i int, first bool) {
+		f.Runes = append(f.Runes, r)
+		f.Origin = append(f.Origin, i)
+		f.Boundary = append(f.Boundary, first && startsWord(original, i))
+	}
+
+	for i, r := range original {
+		if r < 0x80 {
+			add(unicode.ToLower(r), i, true)
+			continue
+		}
+		var lower = unicode.ToLower(r)
+		if expansion, ok := expansions[lower]; ok {
+			for j, e := range expansion {
+				add(e, i, j == 0)
+			}
+			continue
+		}
+		var first = true
+		for _, d := range norm.NFKD.String(string(lower)) {
+			if !unicode.Is(unicode.Mn, d) {
+				add(unicode.ToLower(d), i, first)
+				first = false
+			}
+		}
+	}
+	return f
+}
+
+// At the start of the text, after something that is not a letter or digit, at a change between letters and
+// digits, at an uppercase letter following a lowercase one, or at the last uppercase letter of an acronym followed
+// by a word, like the 'S' of 'HTTPServer'
+func startsWord(text []rune, i int) bool {
+	if i == 0 {
+		return true
+	}
+	var prev, cur = text[i-1], text[i]
+	switch {
+	case !isAlnum(prev):
+		return isAlnum(cur)
+	case unicode.IsLower(prev) && unicode.IsUpper(cur):
+		return true
+	case unicode.IsUpper(prev) && unicode.IsUpper(cur):
+		return i+1 < len(text) && unicode.IsLower(text[i+1])
+	default:
+		return isAlnum(cur) && unicode.IsDigit(prev) != unicode.IsDigit(cur)
+	}
+}
+
+func isAlnum(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r)
+}
@@ -0,0 +1,34 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package fold
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestFold(t *testing.T) {
+	var f = Fold("Æble Café")
+	if string(f.Runes) != "aeble cafe" {
+		t.Errorf("Expected 'aeble cafe', got '%s'", string(f.Runes))
+	}
+	if expected := []int{0, 0, 1, 2, 3, 4, 5, 6, 7, 8}; !reflect.DeepEqual(f.Origin, expected) {
+		t.Errorf("Expected origins %v, got %v", expected, f.Origin)
+	}
+	if expected := []bool{true, false, false, false, false, false, true, false, false, false}; !reflect.DeepEqual(f.Boundary, expected) {
+		t.Errorf("Expected boundaries %v, got %v", expected, f.Boundary)
+	}
+}
+
+func TestStartsWord(t *testing.T) {
+	var text = []rune("fooBar baz-2qux ÆbleÜber HTTPServer")
+	var expected = map[int]bool{0: true, 3: true, 7: true, 11: true, 12: true, 16: true, 20: true, 25: true, 29: true}
+	for i := range text {
+		if startsWord(text, i) != expected[i] {
+			t.Errorf("Position %d ('%c'): expected %t", i, text[i], expected[i])
+		}
+	}
+}
@@ -0,0 +1,127 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package guard
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/surlykke/refude/internal/lib/respond"
+	"github.com/surlykke/refude/internal/lib/xdg"
+)
+
+const cookieName = "refude-token"
+
+/*
+ * Wraps the handler serving the api, so that it can only be used by the session user:
+ *   - Host must be a loopback name, so a dns-rebinding web page can't reach us
+ *   - Origin, when given, must be our own, so other web pages can't post to us
+ *   - If token is non-empty, requests must carry it, as 'Authorization: Bearer <token>' or in a cookie
+ *
+ * The desktop page obtains the cookie by being opened with the token as query parameter. See Make.
+ */
+type Guard struct {
+	token string
+	next  http.Handler
+}
+
+/*
+ * If requireToken, a random token is generated and written to xdg.TokenPath, readable only by the user.
+ * Also a small html file is written to xdg.DesktopLauncherPath, which, when opened in a browser, redirects
+ * to desktopUrl with the token, so the desktop page gets its cookie.
+ * If not requireToken, any such files from a previous run are removed.
+ */
+func Make(next http.Handler, requireToken bool, desktopUrl string) (*Guard, error) {
+	var guard = &Guard{next: next}
+	for _, path := range []string{xdg.TokenPath, xdg.DesktopLauncherPath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+	}
+	if !requireToken {
+		return guard, nil
+	}
+
+	var buf = make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return nil, err
+	}
+	guard.token = hex.EncodeToString(buf)
+	var launcher = fmt.Sprintf(`<!DOCTYPE html><meta http-equiv="refresh" content="0;url=%s?token=%s">`, desktopUrl, guard.token)
+	if err := os.WriteFile(xdg.TokenPath, []byte(guard.token), 0600); err != nil {
+		return nil, err
+	} else if err := os.WriteFile(xdg.DesktopLauncherPath, []byte(launcher), 0600); err != nil {
+		return nil, err
+	}
+	return guard, nil
+}
+
+func (this *Guard) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !isLoopback(r.Host) {
+		respond.Forbidden(w, r, "host must be localhost")
+	} else if origin := r.Header.Get("Origin"); origin != "" && origin != "http://"+r.Host {
+		respond.Forbidden(w, r, "cross-origin requests not allowed")
+	} else if this.token == "" {
+		this.next.ServeHTTP(w, r)
+	} else if this.isToken(r.URL.Query().Get("token")) && r.Method == "GET" && strings.HasPrefix(r.URL.Path, "/desktop/") {
+		http.SetCookie(w, &http.Cookie{Name: cookieName, Value: this.token, Path: "/", HttpOnly: true, SameSite: http.SameSiteLaxMode})
+		http.Redirect(w, r, r.URL.Path, http.StatusSeeOther)
+	} else if !this.authorized(r) {
+		respond.Unauthorized(w, r)
+	} else {
+		this.next.ServeHTTP(w, r)
+	}
+}
+
+// For connections already known to come from the session user, like those on the api socket
+func (this *Guard) WithoutToken() *Guard {
+	return &Guard{next: this.next}
+}
+
+func (this *Guard) authorized(r *http.Request) bool {
+	if bearer, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		return this.isToken(bearer)
+	} else if cookie, err := r.Cookie(cookieName); err == nil {
+		return this.isToken(cookie.Value)
+	} else {
+		return false
+	}
+}
+
+func (this *Guard) isToken(s string) bool {
+	return subtle.ConstantTimeCompare([]byte(s), []byte(this.token)) == 1
+}
+
+func isLoopback(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if host == "localhost" {
+		return true
+	} else if ip := net.ParseIP(host); ip != nil {
+		return ip.IsLoopback()
+	} else {
+		return false
+	}
+}
+
+// For clients: The token written by a server started with requireToken, or "" if there is none
+func ReadToken() string {
+	if bytes, err := os.ReadFile(xdg.TokenPath); err != nil {
+		return ""
+	} else {
+		return strings.TrimSpace(string(bytes))
+	}
+}
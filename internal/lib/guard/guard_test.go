@@ -0,0 +1,53 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package guard
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestGuard(t *testing.T) {
+	var next = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})
+	var open = &Guard{next: next}
+	var closed = &Guard{next: next, token: "secret"}
+
+	var cases = []struct {
+		guard   *Guard
+		method  string
+		target  string
+		headers map[string]string
+		status  int
+	}{
+		{open, "GET", "http://localhost:7938/window/", nil, http.StatusOK},
+		{open, "GET", "http://127.0.0.1:7938/window/", nil, http.StatusOK},
+		{open, "GET", "http://[::1]:7938/window/", nil, http.StatusOK},
+		{open, "GET", "http://evil.example.com:7938/window/", nil, http.StatusForbidden},
+		{open, "POST", "http://localhost:7938/start/shutdown", map[string]string{"Origin": "http://evil.example.com"}, http.StatusForbidden},
+		{open, "POST", "http://localhost:7938/start/shutdown", map[string]string{"Origin": "null"}, http.StatusForbidden},
+		{open, "POST", "http://localhost:7938/start/shutdown", map[string]string{"Origin": "http://localhost:7938"}, http.StatusOK},
+		{closed, "GET", "http://localhost:7938/window/", nil, http.StatusUnauthorized},
+		{closed, "GET", "http://localhost:7938/window/", map[string]string{"Authorization": "Bearer wrong"}, http.StatusUnauthorized},
+		{closed, "GET", "http://localhost:7938/window/", map[string]string{"Authorization": "Bearer secret"}, http.StatusOK},
+		{closed, "GET", "http://localhost:7938/window/", map[string]string{"Cookie": cookieName + "=secret"}, http.StatusOK},
+		{closed, "GET", "http://localhost:7938/window/?token=secret", nil, http.StatusUnauthorized},
+		{closed, "GET", "http://localhost:7938/desktop/?token=secret", nil, http.StatusSeeOther},
+		{closed, "GET", "http://localhost:7938/desktop/?token=wrong", nil, http.StatusUnauthorized},
+	}
+
+	for _, c := range cases {
+		var r = httptest.NewRequest(c.method, c.target, nil)
+		for k, v := range c.headers {
+			r.Header.Set(k, v)
+		}
+		var w = httptest.NewRecorder()
+		c.guard.ServeHTTP(w, r)
+		if w.Code != c.status {
+			t.Errorf("%s %s %v: got %d, expected %d", c.method, c.target, c.headers, w.Code, c.status)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package instance
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+var ErrRunning = errors.New("another instance is running")
+
+/*
+ * Takes an exclusive lock on the file at path, creating it if needed. The lock is held until the process
+ * exits, so a process waiting for the lock (eg. 'flock <path> true') waits until the old instance is gone.
+ * Returns ErrRunning if another process holds the lock.
+ */
+func Lock(path string) error {
+	if file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600); err != nil {
+		return err
+	} else if err := syscall.Flock(int(file.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err == syscall.EWOULDBLOCK {
+		file.Close()
+		return ErrRunning
+	} else if err != nil {
+		file.Close()
+		return err
+	} else {
+		held = file
+		return nil
+	}
+}
+
+// Keeps the file open, and so the lock
+var held *os.File
@@ -0,0 +1,109 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package listen
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+func Tcp(address string) (net.Listener, error) {
+	return net.Listen("tcp", address)
+}
+
+/*
+ * Listens on a unix socket at path, accessible only by the user running refude-server.
+ * As a second line of defence, connections from processes of other users (according to SO_PEERCRED)
+ * are closed on accept.
+ */
+func Unix(path string) (net.Listener, error) {
+	os.Remove(path)
+	if listener, err := net.Listen("unix", path); err != nil {
+		return nil, err
+	} else if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	} else {
+		return peerCheckingListener{listener.(*net.UnixListener)}, nil
+	}
+}
+
+type peerCheckingListener struct {
+	*net.UnixListener
+}
+
+func (this peerCheckingListener) Accept() (net.Conn, error) {
+	for {
+		if conn, err := this.AcceptUnix(); err != nil {
+			return nil, err
+		} else if uid, err := peerUid(conn); err != nil {
+			log.Print("Could not get peer credentials: ", err)
+			conn.Close()
+		} else if uid != uint32(os.Getuid()) {
+			log.Print("Rejecting connection from uid ", uid)
+			conn.Close()
+		} else {
+			return conn, nil
+		}
+	}
+}
+
+func peerUid(conn *net.UnixConn) (uint32, error) {
+	var ucred *syscall.Ucred
+	var credErr error
+	if rawConn, err := conn.SyscallConn(); err != nil {
+		return 0, err
+	} else if err := rawConn.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return 0, err
+	} else if credErr != nil {
+		return 0, credErr
+	} else {
+		return ucred.Uid, nil
+	}
+}
+
+// As per sd_listen_fds(3): passed file descriptors start at 3
+const listenFdsStart = 3
+
+/*
+ * Listeners passed by a socket activating service manager (eg. systemd), through environment variables
+ * LISTEN_PID and LISTEN_FDS. Returns nil if there are none. Unix socket listeners get the same peer check as
+ * those from Unix. The variables are unset, so processes we launch don't see them.
+ */
+func Activated() ([]net.Listener, error) {
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	defer os.Unsetenv("LISTEN_FDNAMES")
+
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	var count, err = strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return nil, nil
+	}
+
+	var listeners = make([]net.Listener, 0, count)
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		var file = os.NewFile(uintptr(fd), fmt.Sprintf("LISTEN_FD_%d", fd))
+		var listener, err = net.FileListener(file) // Duplicates fd, with close-on-exec
+		file.Close()
+		if err != nil {
+			return listeners, fmt.Errorf("passed file descriptor %d: %w", fd, err)
+		} else if unixListener, ok := listener.(*net.UnixListener); ok {
+			listeners = append(listeners, peerCheckingListener{unixListener})
+		} else {
+			listeners = append(listeners, listener)
+		}
+	}
+	return listeners, nil
+}
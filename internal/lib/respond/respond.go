@@ -17,26 +17,97 @@ func Ok(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusOK)
 }
 
-func NotFound(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusNotFound)
+// Body of all error responses. Modelled on RFC 9457 (problem details), with extension
+// members path and action
+type Problem struct {
+	Type   string `json:"type"`
+	Title  string `json:"title"`
+	Status int    `json:"status"`
+	Detail string `json:"detail,omitempty"`
+	Path   string `json:"path,omitempty"`
+	Action string `json:"action,omitempty"`
 }
 
-func NotAllowed(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusMethodNotAllowed)
+func problem(w http.ResponseWriter, r *http.Request, problemType string, status int, detail string) {
+	var p = Problem{
+		Type:   problemType,
+		Title:  http.StatusText(status),
+		Status: status,
+		Detail: detail,
+		Path:   r.URL.Path,
+		Action: r.URL.Query().Get("action"),
+	}
+	w.Header().Set("Content-Type", "application/problem+json")
+	w.WriteHeader(status)
+	w.Write(ToJson(p))
 }
 
-func UnprocessableEntity(w http.ResponseWriter, err error) {
-	if body, err2 := json.Marshal(err.Error()); err2 == nil {
-		w.WriteHeader(http.StatusUnprocessableEntity)
-		w.Write(body)
-	} else {
-		panic(fmt.Sprintf("Cannot json-marshall %s", err.Error()))
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	problem(w, r, "not-found", http.StatusNotFound, "")
+}
+
+func NotAllowed(w http.ResponseWriter, r *http.Request) {
+	problem(w, r, "method-not-allowed", http.StatusMethodNotAllowed, r.Method+" not supported by "+r.URL.Path)
+}
+
+/*
+ * Serves through mux, but where mux itself would answer 404 or 405, with text/plain bodies, answers with
+ * NotFound or NotAllowed instead.
+ */
+func WithProblems(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if handler, pattern := mux.Handler(r); pattern == "" {
+			var probe = &statusProbe{header: make(http.Header)}
+			handler.ServeHTTP(probe, r)
+			if probe.status == http.StatusNotFound {
+				NotFound(w, r)
+				return
+			} else if probe.status == http.StatusMethodNotAllowed {
+				w.Header().Set("Allow", probe.header.Get("Allow"))
+				NotAllowed(w, r)
+				return
+			}
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+// Learns what a handler would answer, without answering
+type statusProbe struct {
+	header http.Header
+	status int
+}
+
+func (this *statusProbe) Header() http.Header {
+	return this.header
+}
+
+func (this *statusProbe) WriteHeader(status int) {
+	if this.status == 0 {
+		this.status = status
 	}
 }
 
-func ServerError(w http.ResponseWriter, err error) {
-	w.WriteHeader(http.StatusInternalServerError)
-	w.Write([]byte(err.Error()))
+func (this *statusProbe) Write(b []byte) (int, error) {
+	this.WriteHeader(http.StatusOK)
+	return len(b), nil
+}
+
+func Unauthorized(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("WWW-Authenticate", "Bearer")
+	problem(w, r, "unauthorized", http.StatusUnauthorized, "missing or wrong bearer token")
+}
+
+func Forbidden(w http.ResponseWriter, r *http.Request, detail string) {
+	problem(w, r, "forbidden", http.StatusForbidden, detail)
+}
+
+func UnprocessableEntity(w http.ResponseWriter, r *http.Request, err error) {
+	problem(w, r, "unprocessable-entity", http.StatusUnprocessableEntity, err.Error())
+}
+
+func ServerError(w http.ResponseWriter, r *http.Request, err error) {
+	problem(w, r, "server-error", http.StatusInternalServerError, err.Error())
 }
 
 func Accepted(w http.ResponseWriter) {
@@ -47,8 +118,8 @@ func NotModified(w http.ResponseWriter) {
 	w.WriteHeader(http.StatusNotModified)
 }
 
-func PreconditionFailed(w http.ResponseWriter) {
-	w.WriteHeader(http.StatusPreconditionFailed)
+func PreconditionFailed(w http.ResponseWriter, r *http.Request) {
+	problem(w, r, "precondition-failed", http.StatusPreconditionFailed, "resource has changed")
 }
 
 func AsJson(w http.ResponseWriter, data interface{}) {
@@ -0,0 +1,56 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package respond
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestWithProblems(t *testing.T) {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("GET /thing/{id}", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.PathValue("id")))
+	})
+	var handler = WithProblems(mux)
+
+	var tests = []struct {
+		method, target string
+		status         int
+		problemType    string
+	}{
+		{"GET", "/thing/a", http.StatusOK, ""},
+		{"GET", "/nothing", http.StatusNotFound, "not-found"},
+		{"DELETE", "/thing/a", http.StatusMethodNotAllowed, "method-not-allowed"},
+		{"GET", "/thing/../thing/a", http.StatusTemporaryRedirect, ""},
+	}
+	for _, test := range tests {
+		var w = httptest.NewRecorder()
+		handler.ServeHTTP(w, httptest.NewRequest(test.method, test.target, nil))
+		if w.Code != test.status {
+			t.Errorf("%s %s: expected %d, got %d", test.method, test.target, test.status, w.Code)
+		} else if test.problemType == "" {
+			continue
+		}
+		var p Problem
+		if err := json.Unmarshal(w.Body.Bytes(), &p); err != nil || p.Type != test.problemType {
+			t.Errorf("%s %s: expected problem of type %s, got %s", test.method, test.target, test.problemType, w.Body.String())
+		}
+	}
+
+	var w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/thing/a", nil))
+	if w.Body.String() != "a" {
+		t.Errorf("Expected path values to be set, got '%s'", w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/thing/a", nil))
+	if w.Header().Get("Allow") != "GET, HEAD" {
+		t.Errorf("Expected Allow header, got '%s'", w.Header().Get("Allow"))
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"log"
 	"os"
 	"regexp"
+	"slices"
 	"strings"
 
 	"github.com/surlykke/refude/internal/lib/translate"
@@ -99,6 +100,62 @@ func WriteIniFile(path string, iniFile IniFile) error {
 	}
 }
 
+/*
+ * Sets key in group of the ini file at path to value, or, if value is empty, removes it. The rest of the file,
+ * comments, other groups and the order of entries included, is left as it was. If there is no group, it is added
+ * at the end, and if there is no file, it is created.
+ */
+func SetIniEntry(path string, group string, key string, value string) error {
+	var bytes, err = os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	var lines = strings.SplitAfter(string(bytes), "\n")
+	if lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var groupStart, groupEnd, keyAt = -1, len(lines), -1 // groupEnd: after the last entry of group
+	for i, line := range lines {
+		line = strings.TrimSuffix(line, "\n")
+		if m := headerLine.FindStringSubmatch(line); len(m) > 0 {
+			if groupStart > -1 {
+				break
+			} else if m[1] == group {
+				groupStart, groupEnd = i, i+1
+			}
+		} else if groupStart > -1 && !commentLine.MatchString(line) {
+			groupEnd = i + 1
+			if m := keyValueLine.FindStringSubmatch(line); len(m) > 0 && m[3] == "" && strings.TrimSpace(m[1]) == key {
+				keyAt = i
+			}
+		}
+	}
+
+	var entry = key + "=" + value + "\n"
+	var terminateLast = func() {
+		if n := len(lines); n > 0 && !strings.HasSuffix(lines[n-1], "\n") {
+			lines[n-1] += "\n"
+		}
+	}
+	if keyAt > -1 && value == "" {
+		lines = slices.Delete(lines, keyAt, keyAt+1)
+	} else if keyAt > -1 {
+		lines[keyAt] = entry
+	} else if value == "" {
+		return nil
+	} else if groupStart > -1 {
+		if groupEnd == len(lines) {
+			terminateLast()
+		}
+		lines = slices.Insert(lines, groupEnd, entry)
+	} else {
+		terminateLast()
+		lines = append(lines, "["+group+"]\n", entry)
+	}
+	return os.WriteFile(path, []byte(strings.Join(lines, "")), 0644)
+}
+
 func readUserDirs(home string, configHome string) (map[string]string, error) {
 	var res = map[string]string{}
 	var file, err = os.Open(configHome + "/user-dirs.dirs")
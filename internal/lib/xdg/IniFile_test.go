@@ -0,0 +1,91 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package xdg
+
+import (
+	"os"
+	"testing"
+)
+
+const mimeapps = `# Written by hand
+[Added Associations]
+text/plain=gvim.desktop;
+
+[Default Applications]
+text/html=firefox.desktop;
+image/png = gimp.desktop;
+image/png[da]=ignored.desktop;
+# Trailing comment
+
+[X-Unknown]
+foo=bar`
+
+func TestSetIniEntry(t *testing.T) {
+	var tests = []struct {
+		group, key, value string
+		expected          string
+	}{
+		{"Default Applications", "image/png", "eog.desktop;", `# Written by hand
+[Added Associations]
+text/plain=gvim.desktop;
+
+[Default Applications]
+text/html=firefox.desktop;
+image/png=eog.desktop;
+image/png[da]=ignored.desktop;
+# Trailing comment
+
+[X-Unknown]
+foo=bar`},
+		{"Default Applications", "text/html", "", `# Written by hand
+[Added Associations]
+text/plain=gvim.desktop;
+
+[Default Applications]
+image/png = gimp.desktop;
+image/png[da]=ignored.desktop;
+# Trailing comment
+
+[X-Unknown]
+foo=bar`},
+		{"Default Applications", "text/x-go", "gvim.desktop;", `# Written by hand
+[Added Associations]
+text/plain=gvim.desktop;
+
+[Default Applications]
+text/html=firefox.desktop;
+image/png = gimp.desktop;
+image/png[da]=ignored.desktop;
+text/x-go=gvim.desktop;
+# Trailing comment
+
+[X-Unknown]
+foo=bar`},
+		{"Removed Associations", "text/plain", "gvim.desktop;", mimeapps + `
+[Removed Associations]
+text/plain=gvim.desktop;
+`},
+		{"Default Applications", "text/x-go", "", mimeapps},
+	}
+
+	var path = t.TempDir() + "/mimeapps.list"
+	for _, test := range tests {
+		if err := os.WriteFile(path, []byte(mimeapps), 0644); err != nil {
+			t.Fatal(err)
+		} else if err := SetIniEntry(path, test.group, test.key, test.value); err != nil {
+			t.Fatal(err)
+		} else if bytes, _ := os.ReadFile(path); string(bytes) != test.expected {
+			t.Errorf("Setting %s in %s to '%s', expected:\n%s\ngot:\n%s", test.key, test.group, test.value, test.expected, bytes)
+		}
+	}
+
+	var newPath = t.TempDir() + "/new.list"
+	if err := SetIniEntry(newPath, "Default Applications", "text/html", "firefox.desktop;"); err != nil {
+		t.Fatal(err)
+	} else if bytes, _ := os.ReadFile(newPath); string(bytes) != "[Default Applications]\ntext/html=firefox.desktop;\n" {
+		t.Errorf("Unexpected new file: %s", bytes)
+	}
+}
@@ -39,6 +39,10 @@ var PicturesDir string
 var VideosDir string
 
 var NmSocketPath string
+var TokenPath string
+var ApiSocketPath string
+var LockPath string
+var DesktopLauncherPath string
 
 func init() {
 	Home = clean(os.Getenv("HOME"))
@@ -78,6 +82,10 @@ func init() {
 	VideosDir = clean(coalesce(userDirs["XDG_VIDEOS_DIR"], Home+"/Videos"))
 
 	NmSocketPath = RuntimeDir + "/org.refude.nm-socket"
+	TokenPath = RuntimeDir + "/org.refude.token"
+	ApiSocketPath = RuntimeDir + "/org.refude.api-socket"
+	LockPath = RuntimeDir + "/org.refude.lock"
+	DesktopLauncherPath = RuntimeDir + "/org.refude.desktop.html"
 }
 
 func RunCmd(argv ...string) error {
@@ -5,6 +5,7 @@ import (
 	"sync"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/utils"
 )
@@ -29,7 +30,7 @@ func conn() *dbus.Conn {
 	return _conn
 }
 
-var Connections = entity.MakeMap[dbus.ObjectPath, *Connection]("/network/")
+var Connections = entity.Register(entity.MakeMap[dbus.ObjectPath, *Connection]("/network/"), entity.SearchOptions{MinTermLength: 3})
 var primaryConnection = dbus.ObjectPath("")
 var _signals = make(chan *dbus.Signal, 50)
 
@@ -148,6 +149,7 @@ func setPrimaryConnection(connection dbus.ObjectPath) {
 
 func Run() {
 	Connections.Serve()
+	health.Get("network").Gauge("connections", Connections.Len)
 	subscribe()
 	initialize()
 	watch()
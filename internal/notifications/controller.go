@@ -7,14 +7,18 @@ package notifications
 
 import (
 	"errors"
+	"fmt"
 	"log"
 	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
+	"github.com/surlykke/refude/internal/config"
 	"github.com/surlykke/refude/internal/file"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/icons"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/image"
@@ -115,6 +119,7 @@ const (
 )
 
 var conn *dbus.Conn
+var subsystem = health.Get("notifications")
 var ids = make(chan uint32)
 
 func generate(out chan uint32) {
@@ -145,6 +150,7 @@ func Notify(
 	expire_timeout int32) (uint32,
 	*dbus.Error) {
 
+	subsystem.Count("received")
 	var id uint32
 	if replaces_id != 0 {
 		id = replaces_id
@@ -209,24 +215,7 @@ func Notify(
 		}
 	}
 
-	switch notification.Urgency {
-	case Low:
-		if expire_timeout >= 2_000 || expire_timeout < 0 {
-			expire_timeout = 2_000
-		}
-	case Normal:
-		if expire_timeout >= 10_000 || expire_timeout < 0 {
-			expire_timeout = 10_000
-		}
-	default:
-		expire_timeout = 3_600_000
-	}
-
-	if expire_timeout < 3_600_000 {
-		time.AfterFunc(time.Duration(expire_timeout+50)*time.Millisecond, func() { removeNotification(id, Expired) })
-	}
-
-	notification.Expires = time.Now().Add(time.Duration(expire_timeout) * time.Millisecond)
+	scheduleExpiry(&notification, expire_timeout)
 
 	NotificationMap.Put(id, &notification)
 
@@ -351,12 +340,14 @@ func Run(noNotifications bool) {
 	}
 
 	NotificationMap.Serve()
+	subsystem.Gauge("notifications", NotificationMap.Len)
 	var err error
 	var reply dbus.RequestNameReply
 
 	defer func() {
 		if err := recover(); err != nil {
 			log.Print(err, "- hence Notifications not running")
+			subsystem.Fail(fmt.Errorf("%v", err))
 		}
 	}()
 
@@ -371,6 +362,7 @@ func Run(noNotifications bool) {
 	if reply != dbus.RequestNameReplyPrimaryOwner {
 		panic(errors.New(NOTIFICATIONS_SERVICE + " taken"))
 	}
+	ownsName.Store(true)
 
 	go generate(ids)
 
@@ -388,7 +380,54 @@ func Run(noNotifications bool) {
 	_ = conn.Export(introspect.Introspectable(INTROSPECT_XML), NOTIFICATIONS_PATH, INTROSPECT_INTERFACE)
 }
 
-var NotificationMap = entity.MakeMap[uint32, *Notification]("/notification/")
+var ownsName atomic.Bool
+
+// Releases NOTIFICATIONS_SERVICE, so a new instance of refude-server may take it right away
+func Shutdown() {
+	if ownsName.Load() {
+		if _, err := conn.ReleaseName(NOTIFICATIONS_SERVICE); err != nil {
+			log.Print("Could not release ", NOTIFICATIONS_SERVICE, ": ", err)
+		}
+	}
+}
+
+var NotificationMap = entity.Register(entity.MakeMap[uint32, *Notification]("/notification/").Coalesce(50*time.Millisecond), entity.SearchOptions{})
+
+// Timeouts are in milliseconds. A requested timeout longer than configured for the urgency, or negative, gives
+// the configured one. Critical notifications don't expire, as such, but are left out of search after an hour
+func timeoutFor(urgency Urgency, requested int32) int32 {
+	var timeouts = config.Get().Notifications
+	switch urgency {
+	case Low:
+		if requested >= timeouts.LowTimeout || requested < 0 {
+			return timeouts.LowTimeout
+		}
+	case Normal:
+		if requested >= timeouts.NormalTimeout || requested < 0 {
+			return timeouts.NormalTimeout
+		}
+	default:
+		return 3_600_000
+	}
+	return requested
+}
+
+// Sets when n expires, from now, and arranges for it to be removed then
+func scheduleExpiry(n *Notification, requested int32) {
+	var timeout = timeoutFor(n.Urgency, requested)
+	var id = n.NotificationId
+	if timeout < 3_600_000 {
+		time.AfterFunc(time.Duration(timeout+50)*time.Millisecond, func() { expire(id) })
+	}
+	n.Expires = time.Now().Add(time.Duration(timeout) * time.Millisecond)
+}
+
+// Expiry may have been postponed since it was scheduled, so checked again
+func expire(id uint32) {
+	if n, ok := NotificationMap.Get(id); ok && n.Expired() {
+		removeNotification(id, Expired)
+	}
+}
 
 func removeNotification(id uint32, reason uint32) {
 	if n, ok := NotificationMap.Get(id); ok && !n.Deleted {
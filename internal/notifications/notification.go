@@ -6,9 +6,12 @@
 package notifications
 
 import (
+	"encoding/json"
+	"fmt"
 	"strconv"
 	"time"
 
+	"github.com/surlykke/refude/internal/config"
 	"github.com/surlykke/refude/internal/lib/entity"
 )
 
@@ -39,6 +42,24 @@ func (u Urgency) MarshalJSON() ([]byte, error) {
 	}
 }
 
+func (u *Urgency) UnmarshalJSON(data []byte) error {
+	switch string(data) {
+	case string(LowBytes):
+		*u = Low
+	case string(NormalBytes):
+		*u = Normal
+	case string(CriticalBytes):
+		*u = Critical
+	default:
+		return fmt.Errorf("urgency must be one of %s, %s or %s", LowBytes, NormalBytes, CriticalBytes)
+	}
+	return nil
+}
+
+func (u Urgency) JSONSchema() map[string]any {
+	return map[string]any{"enum": []string{"low", "normal", "critical"}}
+}
+
 type UnixTime time.Time // Behaves like Time, but json-marshalls to milliseconds since epoch
 
 func (ut UnixTime) MarshalJSON() ([]byte, error) {
@@ -47,6 +68,10 @@ func (ut UnixTime) MarshalJSON() ([]byte, error) {
 	return buf, nil
 }
 
+func (ut UnixTime) JSONSchema() map[string]any {
+	return map[string]any{"type": "integer", "description": "Milliseconds since epoch"}
+}
+
 type Notification struct {
 	entity.Base
 	NotificationId uint32
@@ -67,15 +92,16 @@ func (n *Notification) Expired() bool {
 }
 
 func (n *Notification) SoftExpired() bool {
-	return n.Urgency == Normal && n.Created.Add(10*time.Second).Before(time.Now()) ||
-		n.Urgency == Low && n.Created.Add(2*time.Second).Before(time.Now())
+	var timeouts = config.Get().Notifications
+	return n.Urgency == Normal && n.Created.Add(time.Duration(timeouts.NormalTimeout)*time.Millisecond).Before(time.Now()) ||
+		n.Urgency == Low && n.Created.Add(time.Duration(timeouts.LowTimeout)*time.Millisecond).Before(time.Now())
 }
 
 func (this *Notification) OmitFromSearch() bool {
 	return this.Deleted || this.Expired() || (this.NActions["default"] == "" && this.SoftExpired())
 }
 
-func (n *Notification) DoPost(action string) (bool, error) {
+func (n *Notification) DoPost(action string, args []string) (bool, error) {
 	// FIXME
 	if _, ok := n.NActions[action]; ok {
 		if err := conn.Emit(NOTIFICATIONS_PATH, NOTIFICATIONS_INTERFACE+".ActionInvoked", n.NotificationId, action); err != nil {
@@ -92,3 +118,18 @@ func (n *Notification) DoDelete() error {
 	removeNotification(n.NotificationId, Dismissed)
 	return nil
 }
+
+// Changing Urgency restarts the timeout, as configured for the new urgency
+func (n *Notification) DoPatch(patch map[string]json.RawMessage) (entity.Servable, error) {
+	var copy = *n
+	if n.Deleted {
+		return nil, entity.PatchError{Field: "Deleted", Problem: "notification is deleted, and cannot be patched"}
+	} else if err := entity.CheckPatchFields(patch, "Urgency"); err != nil {
+		return nil, err
+	} else if _, err := entity.PatchField(patch, "Urgency", &copy.Urgency); err != nil {
+		return nil, err
+	} else if copy.Urgency != n.Urgency {
+		scheduleExpiry(&copy, -1)
+	}
+	return &copy, nil
+}
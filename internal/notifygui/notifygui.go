@@ -13,6 +13,8 @@ package notifygui
 */
 import "C"
 import (
+	"context"
+
 	"github.com/surlykke/refude/internal/icons"
 	"github.com/surlykke/refude/internal/notifications"
 )
@@ -33,7 +35,9 @@ func run() {
 	var notificationEvents = notifications.NotificationMap.Events.Subscribe()
 	sendNotificationsToGui()
 	for {
-		notificationEvents.Next()
+		if _, err := notificationEvents.NextContext(context.Background()); err != nil {
+			return
+		}
 		sendNotificationsToGui()
 	}
 }
@@ -11,15 +11,22 @@ import (
 	"github.com/jessevdk/go-flags"
 )
 
+// Where refude-server serves the api over tcp, unless told otherwise. Also where clients look for it
+const DefaultAddress = "127.0.0.1:7938"
+
 type Options struct {
 	NoNotifications bool            `long:"no-notifications" description:"Omit notification functionality"`
 	NoTrayBattery   bool            `long:"no-tray-battery" description:"Dont show tray battery applet"`
 	IgnoreWinAppIds map[string]bool `long:"ignore-window" description:"Omit windows with these app-ids from search"`
+	Address         string          `long:"address" description:"Tcp address to serve the api on. The api is also served on $XDG_RUNTIME_DIR/org.refude.api-socket"`
+	RequireToken    bool            `long:"require-token" description:"Require clients to present the token written to $XDG_RUNTIME_DIR/org.refude.token"`
 }
 
 func GetOpts() Options {
 	var opts = Options{}
-	if _, err := flags.Parse(&opts); err != nil {
+	var parser = flags.NewParser(&opts, flags.Default)
+	parser.FindOptionByLongName("address").Default = []string{DefaultAddress}
+	if _, err := parser.Parse(); err != nil {
 		os.Exit(0)
 	}
 	return opts
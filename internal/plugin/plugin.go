@@ -0,0 +1,423 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+
+/*
+ * A plugin is an executable in $XDG_CONFIG_HOME/refude/plugins. refude-server starts it, and talks to it with json
+ * messages, one per line, on its stdin and stdout. Anything it writes to stderr goes to the log. When refude-server
+ * goes away the plugin's stdin is closed, and it should exit.
+ *
+ * Plugin to refude:
+ *
+ *   {"type": "entities", "entities": [<entity>, ...]}   Replaces all entities from the plugin
+ *   {"type": "put", "entity": <entity>}                 Adds or replaces one entity
+ *   {"type": "remove", "id": "<id>"}                    Removes one
+ *   {"type": "search"}                                  Plugin wants search terms
+ *   {"type": "results", "seq": <n>, "entities": [...]}  Answer to search <n>
+ *
+ * Refude to plugin:
+ *
+ *   {"type": "invoke", "id": "<id>", "action": "<action id>", "args": ["..", ..]}
+ *   {"type": "search", "seq": <n>, "term": "<term>"}    Only if plugin asked for search terms
+ *
+ * where <entity> is
+ *
+ *   {"id": "vm1", "title": "Vm 1", "subtitle": "Stopped", "icon": "computer", "type": "VM",
+ *    "keywords": ["qemu"], "actions": [{"id": "", "name": "Start"}, {"id": "delete", "name": "Delete"}]}
+ *
+ * An entity of plugin 'vms' with id 'vm1' is served at /plugin/vms/vm1. Posting there invokes its action, and is
+ * answered with 'not found' if the entity has no such action.
+ * Search results should be given within searchTimeout. They are served like other entities, at
+ * /plugin/vms/search/<id>, until the next results from the same plugin, but are not found by other search terms, and
+ * not announced to watchers. Hence ids of other entities must not start with 'search/'.
+ * Messages to a plugin are queued, and dropped if it has more than sendQueueSize unread.
+ * A plugin that doesn't answer in time is not asked again, nor waited for, until it has answered.
+ */
+package plugin
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surlykke/refude/internal/health"
+	"github.com/surlykke/refude/internal/lib/entity"
+	"github.com/surlykke/refude/internal/lib/xdg"
+)
+
+const searchTimeout = 300 * time.Millisecond
+const restartDelay = 10 * time.Second
+const sendQueueSize = 64
+
+type message struct {
+	Type     string       `json:"type"`
+	Seq      uint64       `json:"seq,omitempty"`
+	Term     string       `json:"term,omitempty"`
+	Id       string       `json:"id,omitempty"`
+	Action   string       `json:"action,omitempty"`
+	Args     []string     `json:"args,omitempty"`
+	Entity   *entitySpec  `json:"entity,omitempty"`
+	Entities []entitySpec `json:"entities,omitempty"`
+}
+
+type entitySpec struct {
+	Id       string          `json:"id"`
+	Title    string          `json:"title"`
+	Subtitle string          `json:"subtitle"`
+	Icon     string          `json:"icon"`
+	Type     string          `json:"type"`
+	Keywords []string        `json:"keywords"`
+	Actions  []entity.Action `json:"actions"`
+}
+
+type Entity struct {
+	entity.Base
+	plugin  *plugin
+	id      string
+	dynamic bool
+}
+
+func (this *Entity) OmitFromSearch() bool {
+	return this.dynamic
+}
+
+func (this *Entity) DoPost(action string, args []string) (bool, error) {
+	if !slices.ContainsFunc(this.Actions, func(a entity.Action) bool { return a.Id == action }) {
+		return false, nil
+	}
+	return true, this.plugin.send(message{Type: "invoke", Id: this.id, Action: action, Args: args})
+}
+
+type collection struct {
+	*entity.EntityMap[string, *Entity]
+}
+
+var Plugins = entity.Register(collection{entity.MakeMap[string, *Entity]("/plugin/")}, entity.SearchOptions{MinTermLength: 1})
+
+var subsystem = health.Get("plugins")
+
+func Run() {
+	Plugins.Serve()
+	subsystem.Gauge("entities", Plugins.Len)
+
+	var dir = xdg.ConfigHome + "/refude/plugins"
+	var entries, err = os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		subsystem.Degrade(err)
+		return
+	}
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil && info.Mode().IsRegular() && info.Mode().Perm()&0111 != 0 {
+			go supervise(entry.Name(), dir+"/"+entry.Name())
+		}
+	}
+}
+
+// Runs the plugin, and restarts it should it exit
+func supervise(name, executable string) {
+	for {
+		var p = makePlugin(name)
+		subsystem.Count("starts")
+		if err := p.run(exec.Command(executable)); err != nil {
+			log.Print("plugin ", name, ": ", err)
+			subsystem.Degrade(fmt.Errorf("plugin %s: %w", name, err))
+		}
+		p.clear()
+		time.Sleep(restartDelay)
+	}
+}
+
+type plugin struct {
+	name      string
+	lock      sync.Mutex
+	outbox    chan []byte // Lines for the plugin's stdin
+	done      chan struct{}
+	stopOnce  sync.Once
+	searching bool
+	lagging   bool // A search timed out, and the plugin has not answered it yet
+	seq       uint64
+	pending   map[uint64]chan []entitySpec
+}
+
+func makePlugin(name string) *plugin {
+	return &plugin{
+		name:    name,
+		outbox:  make(chan []byte, sendQueueSize),
+		done:    make(chan struct{}),
+		pending: make(map[uint64]chan []entitySpec),
+	}
+}
+
+// Closes the plugin's stdin, which should make it exit
+func (this *plugin) stop() {
+	this.stopOnce.Do(func() { close(this.done) })
+}
+
+// Removes the plugin from running, and its entities
+func (this *plugin) clear() {
+	setPlugin(this.name, nil)
+	Plugins.Replace(nil, func(e *Entity) bool { return e.plugin == this && !e.dynamic })
+	Plugins.ReplaceUnpublished(nil, func(e *Entity) bool { return e.plugin == this })
+}
+
+var running = make(map[string]*plugin)
+var runningLock sync.Mutex
+
+func setPlugin(name string, p *plugin) {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	if p == nil {
+		delete(running, name)
+	} else {
+		running[name] = p
+	}
+}
+
+func runningPlugins() []*plugin {
+	runningLock.Lock()
+	defer runningLock.Unlock()
+	var list = make([]*plugin, 0, len(running))
+	for _, p := range running {
+		list = append(list, p)
+	}
+	return list
+}
+
+// Starts cmd and handles what it sends until it closes its stdout
+func (this *plugin) run(cmd *exec.Cmd) error {
+	defer this.stop()
+	var stdin io.WriteCloser
+	var stdout io.Reader
+	var err error
+	if stdin, err = cmd.StdinPipe(); err != nil {
+		return err
+	} else if stdout, err = cmd.StdoutPipe(); err != nil {
+		return err
+	}
+	cmd.Stderr = logWriter{this.name}
+	if err = cmd.Start(); err != nil {
+		return err
+	}
+	go this.write(stdin)
+	setPlugin(this.name, this)
+
+	var scanner = bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 0, 65536), 16*1024*1024)
+	for scanner.Scan() {
+		var msg message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			log.Print("plugin ", this.name, " sent invalid json: ", err)
+		} else if err := this.receive(msg); err != nil {
+			log.Print("plugin ", this.name, ": ", err)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+	return cmd.Wait()
+}
+
+func (this *plugin) receive(msg message) error {
+	switch msg.Type {
+	case "entities":
+		if entities, err := this.makeEntities(msg.Entities, false); err != nil {
+			return err
+		} else {
+			Plugins.Replace(entities, func(e *Entity) bool { return e.plugin == this && !e.dynamic })
+		}
+	case "put":
+		if msg.Entity == nil {
+			return errors.New("put without entity")
+		} else if entities, err := this.makeEntities([]entitySpec{*msg.Entity}, false); err != nil {
+			return err
+		} else {
+			for key, e := range entities {
+				Plugins.Put(key, e)
+			}
+		}
+	case "remove":
+		Plugins.Remove(this.key(msg.Id, false))
+	case "search":
+		this.lock.Lock()
+		this.searching = true
+		this.lock.Unlock()
+	case "results":
+		this.lock.Lock()
+		var waiting, ok = this.pending[msg.Seq]
+		delete(this.pending, msg.Seq)
+		if msg.Seq == this.seq {
+			this.lagging = false
+		}
+		this.lock.Unlock()
+		if ok {
+			waiting <- msg.Entities
+		}
+	default:
+		return fmt.Errorf("unknown message type '%s'", msg.Type)
+	}
+	return nil
+}
+
+// Writes what is queued to stdin, until stopped. A write to a plugin that has exited fails, as its stdin is
+// closed when it is waited for
+func (this *plugin) write(stdin io.WriteCloser) {
+	defer stdin.Close()
+	for {
+		select {
+		case line := <-this.outbox:
+			if _, err := stdin.Write(line); err != nil {
+				log.Print("plugin ", this.name, ": ", err)
+				return
+			}
+		case <-this.done:
+			return
+		}
+	}
+}
+
+func (this *plugin) makeEntities(specs []entitySpec, dynamic bool) (map[string]*Entity, error) {
+	var entities = make(map[string]*Entity, len(specs))
+	for _, spec := range specs {
+		if spec.Id == "" || spec.Title == "" {
+			return nil, errors.New("entities must have id and title")
+		} else if !dynamic && strings.HasPrefix(spec.Id, "search/") {
+			return nil, fmt.Errorf("id '%s': 'search/' is for search results", spec.Id)
+		}
+		var e = &Entity{
+			Base:    *entity.MakeBase(spec.Title, spec.Subtitle, spec.Icon, spec.Type, spec.Keywords...),
+			plugin:  this,
+			id:      spec.Id,
+			dynamic: dynamic,
+		}
+		if e.Kind == "" {
+			e.Kind = "Plugin"
+		}
+		for _, a := range spec.Actions {
+			e.AddAction(a.Id, a.Name, a.Icon)
+		}
+		entities[this.key(spec.Id, dynamic)] = e
+	}
+	return entities, nil
+}
+
+// Search results have their own namespace, so they can't replace other entities
+func (this *plugin) key(id string, dynamic bool) string {
+	if dynamic {
+		return this.name + "/search/" + id
+	} else {
+		return this.name + "/" + id
+	}
+}
+
+// Queues msg for the plugin. Fails if the plugin has stopped, or doesn't keep up reading
+func (this *plugin) send(msg message) error {
+	var bytes, err = json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	select {
+	case <-this.done:
+		return errors.New("plugin stopped")
+	default:
+	}
+	select {
+	case this.outbox <- append(bytes, '\n'):
+		return nil
+	default:
+		subsystem.Count("dropped messages")
+		return errors.New("plugin not reading, message dropped")
+	}
+}
+
+// Asks the plugin for results for term. Returns nil if the plugin hasn't asked for search terms, is lagging, or
+// doesn't answer in time
+func (this *plugin) search(term string) []entitySpec {
+	this.lock.Lock()
+	if !this.searching || this.lagging {
+		this.lock.Unlock()
+		return nil
+	}
+	this.seq++
+	var seq = this.seq
+	var results = make(chan []entitySpec, 1)
+	this.pending[seq] = results
+	this.lock.Unlock()
+
+	defer func() {
+		this.lock.Lock()
+		delete(this.pending, seq)
+		this.lock.Unlock()
+	}()
+
+	if err := this.send(message{Type: "search", Seq: seq, Term: term}); err != nil {
+		return nil
+	}
+	select {
+	case specs := <-results:
+		return specs
+	case <-time.After(searchTimeout):
+		subsystem.Count("search timeouts")
+		this.lock.Lock()
+		_, unanswered := this.pending[seq]
+		this.lagging = unanswered && seq == this.seq
+		this.lock.Unlock()
+		return nil
+	}
+}
+
+// Asks all plugins that want search terms, concurrently
+func (this collection) SearchFor(term string) []entity.Base {
+	var plugins = runningPlugins()
+	var results = make([][]entitySpec, len(plugins))
+	var wg sync.WaitGroup
+	for i, p := range plugins {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i] = p.search(term)
+		}()
+	}
+	wg.Wait()
+
+	var bases = make([]entity.Base, 0, 20)
+	for i, specs := range results {
+		var p = plugins[i]
+		if specs == nil {
+			continue
+		} else if entities, err := p.makeEntities(specs, true); err != nil {
+			log.Print("plugin ", p.name, ": ", err)
+		} else {
+			this.ReplaceUnpublished(entities, func(e *Entity) bool { return e.plugin == p && e.dynamic })
+			for _, spec := range specs { // In the order the plugin gave them
+				bases = append(bases, *entities[p.key(spec.Id, true)].GetBase())
+			}
+		}
+	}
+	return bases
+}
+
+type logWriter struct {
+	name string
+}
+
+func (this logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		log.Print("plugin ", this.name, ": ", line)
+	}
+	return len(p), nil
+}
@@ -0,0 +1,116 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package plugin
+
+import (
+	"context"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+// Announces one entity and that it wants search terms. Answers searches with one result, and
+// invocations by changing the subtitle of the entity
+const testPlugin = `
+echo '{"type": "entities", "entities": [{"id": "a", "title": "Alpha", "actions": [{"id": "", "name": "Run"}]}]}'
+echo '{"type": "search"}'
+while read -r line; do
+	case "$line" in
+		*'"search"'*)
+			seq=$(echo "$line" | sed 's/.*"seq":\([0-9]*\).*/\1/')
+			echo '{"type": "results", "seq": '$seq', "entities": [{"id": "dyn", "title": "Dynamic"}]}'
+			;;
+		*'"invoke"'*)
+			echo '{"type": "put", "entity": {"id": "a", "title": "Alpha", "subtitle": "invoked"}}'
+			;;
+	esac
+done
+`
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for ", what)
+		}
+	}
+}
+
+func TestPlugin(t *testing.T) {
+	var p = makePlugin("test")
+	var exited = make(chan error, 1)
+	go func() { exited <- p.run(exec.Command("sh", "-c", testPlugin)) }()
+	t.Cleanup(func() {
+		p.stop()
+		<-exited
+		p.clear()
+	})
+
+	waitFor(t, "entities", func() bool { _, ok := Plugins.Get("test/a"); return ok })
+	var a, _ = Plugins.Get("test/a")
+	if a.Path != "/plugin/test/a" || a.OmitFromSearch() {
+		t.Errorf("Unexpected entity: %v", a)
+	}
+	waitFor(t, "search request", func() bool { p.lock.Lock(); defer p.lock.Unlock(); return p.searching })
+
+	var subscription = Plugins.Events.Subscribe()
+	defer subscription.Close()
+	var results = Plugins.SearchFor("dyn")
+	if len(results) != 1 || results[0].Path != "/plugin/test/search/dyn" {
+		t.Errorf("Unexpected search results: %v", results)
+	}
+	if dyn, ok := Plugins.Get("test/search/dyn"); !ok || !dyn.OmitFromSearch() {
+		t.Error("Search result should be gettable, but not searchable")
+	}
+	var ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if evt, err := subscription.NextContext(ctx); err == nil {
+		t.Errorf("Search results should not be published, got %v", evt)
+	}
+
+	if ok, err := a.DoPost("unknown", nil); ok || err != nil {
+		t.Errorf("Unknown action gave %t, %v", ok, err)
+	}
+	if ok, err := a.DoPost("", nil); !ok || err != nil {
+		t.Errorf("Action gave %t, %v", ok, err)
+	}
+	waitFor(t, "update", func() bool { a, _ := Plugins.Get("test/a"); return a.Subtitle == "invoked" })
+
+	if err := p.receive(message{Type: "put", Entity: &entitySpec{Id: "search/dyn", Title: "Clash"}}); err == nil {
+		t.Error("Expected id starting with 'search/' refused")
+	}
+}
+
+func TestSendQueue(t *testing.T) {
+	var p = makePlugin("full")
+	for range sendQueueSize {
+		if err := p.send(message{Type: "search"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.send(message{Type: "search"}); err == nil {
+		t.Error("Expected send to fail when queue is full")
+	}
+	p.stop()
+	if err := p.send(message{Type: "search"}); err == nil {
+		t.Error("Expected send to fail when stopped")
+	}
+}
+
+func TestLaggingPlugin(t *testing.T) {
+	var p = makePlugin("slow") // Nothing reads what is sent
+	p.searching = true
+	if results := p.search("a"); results != nil || !p.lagging {
+		t.Fatalf("Expected no results and plugin lagging, got %v, %t", results, p.lagging)
+	}
+	var start = time.Now()
+	if results := p.search("ab"); results != nil || time.Since(start) > searchTimeout/2 {
+		t.Errorf("Expected lagging plugin not waited for")
+	}
+	p.receive(message{Type: "results", Seq: p.seq})
+	if p.lagging {
+		t.Error("Expected plugin not lagging after answering")
+	}
+}
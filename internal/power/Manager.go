@@ -10,6 +10,7 @@ import (
 	"log"
 
 	"github.com/godbus/dbus/v5"
+	"github.com/surlykke/refude/internal/config"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/utils"
 	"github.com/surlykke/refude/internal/notifications"
@@ -48,6 +49,7 @@ func retrieveDevicePaths() []dbus.ObjectPath {
 	enumCall := dbusConn.Object(upowerService, upowerPath).Call(upowerInterface+".EnumerateDevices", dbus.Flags(0))
 	if enumCall.Err != nil {
 		log.Println("Error on call to upower:", enumCall.Err)
+		subsystem.Degrade(enumCall.Err)
 		return nil
 	}
 	return append(enumCall.Body[0].([]dbus.ObjectPath), displayDeviceDbusPath)
@@ -119,11 +121,12 @@ func updateTrayIcon() {
 func notifyOnLow() {
 	if displayDevice, ok := DeviceMap.Get(dbusPath2id(displayDeviceDbusPath)); ok {
 		if displayDevice.State == "Discharging" {
-			if displayDevice.Percentage <= 5 {
+			var thresholds = config.Get().Battery
+			if displayDevice.Percentage <= thresholds.Critical {
 				notifications.Notify("refude", notificationId, "dialog-warning", "Battery critical", fmt.Sprintf("At %.2f%%", displayDevice.Percentage), []string{}, map[string]dbus.Variant{"urgency": dbus.MakeVariant(uint8(2))}, -1)
-			} else if displayDevice.Percentage <= 10 && previousPercentage > 10 {
+			} else if displayDevice.Percentage <= thresholds.Low && previousPercentage > thresholds.Low {
 				notifications.Notify("refude", notificationId, "dialog-information", "Battery", fmt.Sprintf("At %.2f%%", displayDevice.Percentage), []string{}, map[string]dbus.Variant{}, 10000)
-			} else if displayDevice.Percentage <= 15 && previousPercentage > 15 {
+			} else if displayDevice.Percentage <= thresholds.Notice && previousPercentage > thresholds.Notice {
 				notifications.Notify("refude", notificationId, "dialog-information", "Battery", fmt.Sprintf("At %.2f%%", displayDevice.Percentage), []string{}, map[string]dbus.Variant{}, 5000)
 			}
 			previousPercentage = displayDevice.Percentage
@@ -7,16 +7,21 @@ package power
 
 import (
 	"log"
+	"time"
 
 	"github.com/godbus/dbus/v5"
 
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 )
 
-var DeviceMap = entity.MakeMap[string, *Device]("/device/")
+var DeviceMap = entity.Register(entity.MakeMap[string, *Device]("/device/").Coalesce(250*time.Millisecond), entity.SearchOptions{MinTermLength: 3})
+
+var subsystem = health.Get("power")
 
 func Run(dontShowTrayBattery bool) {
 	DeviceMap.Serve()
+	subsystem.Gauge("devices", DeviceMap.Len)
 	var signals = subscribe()
 
 	DeviceMap.Put(retrieveDevice(displayDeviceDbusPath))
@@ -26,7 +31,7 @@ func Run(dontShowTrayBattery bool) {
 		DeviceMap.Put(retrieveDevice(dbusPath))
 	}
 	if !dontShowTrayBattery {
-		go tray_applet_run()
+		health.Go("tray-battery", tray_applet_run)
 	}
 
 	for signal := range signals {
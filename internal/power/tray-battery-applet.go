@@ -1,12 +1,16 @@
 package power
 
 import (
+	"context"
 	"fmt"
+	"log"
 	"os"
+	"sync/atomic"
 
 	"github.com/godbus/dbus/v5"
 	"github.com/godbus/dbus/v5/introspect"
 	"github.com/godbus/dbus/v5/prop"
+	"github.com/surlykke/refude/internal/lib/entity"
 )
 
 const WATCHER_SERVICE string = "org.kde.StatusNotifierWatcher"
@@ -47,6 +51,17 @@ func propOf(val string, writeable bool, emit prop.EmitType, callBack func(change
 	}
 }
 
+var trayConn atomic.Pointer[dbus.Conn]
+
+// Releases DBUS_SNI_SERVICE_NAME, so a new instance of refude-server may take it right away
+func Shutdown() {
+	if conn := trayConn.Load(); conn != nil {
+		if _, err := conn.ReleaseName(DBUS_SNI_SERVICE_NAME); err != nil {
+			log.Print("Could not release ", DBUS_SNI_SERVICE_NAME, ": ", err)
+		}
+	}
+}
+
 func tray_applet_run() {
 	fmt.Println("tray_applet_run")
 
@@ -66,6 +81,7 @@ func tray_applet_run() {
 	} else if reply != dbus.RequestNameReplyPrimaryOwner {
 		panic("name already taken")
 	}
+	trayConn.Store(conn)
 
 	var batteryObject BatteryObject
 	if err = conn.Export(batteryObject, DBUS_SNI_OBJECT_PATH, SNI_INTERFACE); err != nil {
@@ -146,7 +162,10 @@ func getIconName() string {
 
 func watchBattery(props *prop.Properties) {
 	var prevIcon = ""
-	var subscription = DeviceMap.Events.Subscribe()
+	// The icon only depends on the display device
+	var subscription = DeviceMap.Events.SubscribeWhere(func(evt entity.Event) bool {
+		return evt.Path == DeviceMap.Prefix+"DisplayDevice" || evt.Op == entity.OpReset
+	})
 	for {
 		var iconName = getIconName()
 		if iconName != prevIcon {
@@ -155,6 +174,8 @@ func watchBattery(props *prop.Properties) {
 				fmt.Println("Error setting IconName:", err)
 			}
 		}
-		subscription.Next()
+		if _, err := subscription.NextContext(context.Background()); err != nil {
+			return
+		}
 	}
 }
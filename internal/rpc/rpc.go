@@ -0,0 +1,279 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+
+/*
+ * A websocket at /rpc, speaking json-rpc 2.0. Over one connection a client can fetch and invoke entities, search
+ * and follow events, rather than combining /watch with separate requests.
+ *
+ * Methods:
+ *
+ *   get          {"path": "/window/12"}                                     The entity or collection, as with GET
+ *   invoke       {"path": "/application/gimp", "action": "", "args": [..],  As POST. Result: {"status": 202}
+ *                 "term": "gi"}                                            Term, if given, is used for ranking
+ *   delete       {"path": "/notification/17"}                               As DELETE. Result: {"status": 202}
+ *   search       {"term": "fire"}                                           As /search
+ *   subscribe    {"prefixes": ["/window/", "/notification/"]}               As /watch. Result: {"subscription": 1}
+ *   unsubscribe  {"subscription": 1}                                        Result: true
+ *
+ * A search is answered with error requestCancelled if a later search on the same connection comes in before it is
+ * done, so a client may just send the term as it changes. Failed gets, invokes and deletes are answered with the
+ * http status as error code, and the problem details as error data.
+ * While subscribed, the client gets notifications like:
+ *
+ *   {"jsonrpc": "2.0", "method": "event", "params": {"subscription": 1, "id": 17923, "op": "put", "path": "/window/12", "data": {..}}}
+ *
+ * /watch, /rpc and /batch can't be got, invoked or deleted this way.
+ * Requests on a connection are handled concurrently, so responses may come in another order than the requests.
+ */
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/surlykke/refude/internal/batch"
+	"github.com/surlykke/refude/internal/lib/entity"
+	"github.com/surlykke/refude/internal/lib/respond"
+	"github.com/surlykke/refude/internal/search"
+	"github.com/surlykke/refude/internal/watch"
+	"github.com/surlykke/refude/pkg/pubsub"
+	"golang.org/x/net/websocket"
+)
+
+const version = "2.0"
+
+// As defined by json-rpc 2.0, and, for requestCancelled, the language server protocol
+const (
+	parseError       = -32700
+	invalidRequest   = -32600
+	methodNotFound   = -32601
+	invalidParams    = -32602
+	internalError    = -32603
+	requestCancelled = -32800
+)
+
+type request struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"` // Absent for notifications, which are not answered
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params"`
+}
+
+type response struct {
+	Jsonrpc string          `json:"jsonrpc"`
+	Id      json.RawMessage `json:"id"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+type notification struct {
+	Jsonrpc string `json:"jsonrpc"`
+	Method  string `json:"method"`
+	Params  any    `json:"params"`
+}
+
+type eventParams struct {
+	Subscription uint64 `json:"subscription"`
+	Id           uint64 `json:"id"`
+	entity.Event
+}
+
+type params struct {
+	Path         string   `json:"path"`
+	Action       string   `json:"action"`
+	Args         []string `json:"args"`
+	Term         string   `json:"term"`
+	Prefixes     []string `json:"prefixes"`
+	Subscription uint64   `json:"subscription"`
+}
+
+var nullId = json.RawMessage("null")
+
+func Run() {
+	// Origin is checked by the access guard, so no handshake check here
+	http.Handle("GET /rpc", websocket.Server{Handler: serve})
+}
+
+type connection struct {
+	ws            *websocket.Conn
+	request       *http.Request
+	writeLock     sync.Mutex
+	lock          sync.Mutex
+	subscriptions map[uint64]*pubsub.Subscription[watch.NumberedEvent]
+	lastId        uint64
+	cancelSearch  context.CancelFunc
+}
+
+func serve(ws *websocket.Conn) {
+	// Request context is done on server shutdown. Closing ws then makes Receive return
+	var ctx, cancel = context.WithCancel(ws.Request().Context())
+	defer cancel()
+	context.AfterFunc(ctx, func() { ws.Close() })
+
+	var c = &connection{
+		ws:            ws,
+		request:       ws.Request(),
+		subscriptions: make(map[uint64]*pubsub.Subscription[watch.NumberedEvent]),
+	}
+	for {
+		var data []byte
+		if err := websocket.Message.Receive(ws, &data); err == io.EOF || ctx.Err() != nil {
+			return
+		} else if err != nil {
+			log.Print("rpc: ", err)
+			return
+		}
+		var req request
+		if err := json.Unmarshal(data, &req); err != nil {
+			c.send(response{Jsonrpc: version, Id: nullId, Error: &rpcError{Code: parseError, Message: err.Error()}})
+		} else if req.Jsonrpc != version || req.Method == "" {
+			c.send(response{Jsonrpc: version, Id: nullId, Error: &rpcError{Code: invalidRequest, Message: "not a json-rpc 2.0 request"}})
+		} else {
+			go c.handle(ctx, req)
+		}
+	}
+}
+
+func (this *connection) handle(ctx context.Context, req request) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Print("rpc: panic handling ", req.Method, ": ", r)
+			this.reply(req, nil, &rpcError{Code: internalError, Message: fmt.Sprint(r)})
+		}
+	}()
+
+	var p params
+	if len(req.Params) > 0 {
+		if err := json.Unmarshal(req.Params, &p); err != nil {
+			this.reply(req, nil, &rpcError{Code: invalidParams, Message: err.Error()})
+			return
+		}
+	}
+
+	var result any
+	var rpcErr *rpcError
+	switch req.Method {
+	case "get":
+		result, rpcErr = this.perform(batch.Operation{Method: "GET", Path: p.Path}, false)
+	case "invoke":
+		var body json.RawMessage
+		if p.Args != nil {
+			body = respond.ToJson(p.Args)
+		}
+		result, rpcErr = this.perform(batch.Operation{Method: "POST", Path: p.Path, Action: p.Action, Term: p.Term, Body: body}, true)
+	case "delete":
+		result, rpcErr = this.perform(batch.Operation{Method: "DELETE", Path: p.Path}, true)
+	case "search":
+		result, rpcErr = this.search(ctx, p.Term)
+	case "subscribe":
+		result, rpcErr = this.subscribe(ctx, p.Prefixes)
+	case "unsubscribe":
+		result, rpcErr = this.unsubscribe(p.Subscription)
+	default:
+		rpcErr = &rpcError{Code: methodNotFound, Message: "no method '" + req.Method + "'"}
+	}
+	this.reply(req, result, rpcErr)
+}
+
+// With statusOnly, a successful outcome gives {"status": ..} as result, otherwise its body
+func (this *connection) perform(op batch.Operation, statusOnly bool) (any, *rpcError) {
+	var outcome = batch.Perform(this.request, op)
+	if outcome.Status >= 300 {
+		return nil, &rpcError{Code: outcome.Status, Message: http.StatusText(outcome.Status), Data: outcome.Body}
+	} else if statusOnly || len(outcome.Body) == 0 {
+		return map[string]int{"status": outcome.Status}, nil
+	} else {
+		return outcome.Body, nil
+	}
+}
+
+// Cancels the search in progress on this connection, if any
+func (this *connection) search(ctx context.Context, term string) (any, *rpcError) {
+	this.lock.Lock()
+	if this.cancelSearch != nil {
+		this.cancelSearch()
+	}
+	var searchCtx, cancel = context.WithCancel(ctx)
+	defer cancel()
+	this.cancelSearch = cancel
+	this.lock.Unlock()
+
+	var q = search.Parse(term)
+	var result = search.Response{Query: q, Results: search.SearchQuery(q)}
+	if searchCtx.Err() != nil {
+		return nil, &rpcError{Code: requestCancelled, Message: "superseded by a later search"}
+	}
+	return result, nil
+}
+
+func (this *connection) subscribe(ctx context.Context, prefixes []string) (any, *rpcError) {
+	var subscription, err = watch.Subscribe(prefixes)
+	if err != nil {
+		return nil, &rpcError{Code: invalidParams, Message: err.Error()}
+	}
+	this.lock.Lock()
+	this.lastId++
+	var id = this.lastId
+	this.subscriptions[id] = subscription
+	this.lock.Unlock()
+
+	go this.forward(ctx, id, subscription)
+	return map[string]uint64{"subscription": id}, nil
+}
+
+func (this *connection) unsubscribe(id uint64) (any, *rpcError) {
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	if subscription, ok := this.subscriptions[id]; !ok {
+		return nil, &rpcError{Code: invalidParams, Message: "no such subscription"}
+	} else {
+		delete(this.subscriptions, id)
+		subscription.Close()
+		return true, nil
+	}
+}
+
+func (this *connection) forward(ctx context.Context, id uint64, subscription *pubsub.Subscription[watch.NumberedEvent]) {
+	defer subscription.Close()
+	for {
+		if evt, err := subscription.NextContext(ctx); err != nil {
+			return
+		} else if evt.Id == 0 {
+			continue // Heartbeat. Websockets have their own keep-alive
+		} else if err := this.send(notification{Jsonrpc: version, Method: "event", Params: eventParams{Subscription: id, Id: evt.Id, Event: evt.Event}}); err != nil {
+			return
+		}
+	}
+}
+
+func (this *connection) reply(req request, result any, rpcErr *rpcError) {
+	if req.Id == nil {
+		return // A notification
+	}
+	var res = response{Jsonrpc: version, Id: req.Id, Error: rpcErr}
+	if rpcErr == nil {
+		res.Result = respond.ToJson(result)
+	}
+	this.send(res)
+}
+
+// Sends a response or notification
+func (this *connection) send(msg any) error {
+	this.writeLock.Lock()
+	defer this.writeLock.Unlock()
+	return websocket.Message.Send(this.ws, string(respond.ToJson(msg)))
+}
@@ -0,0 +1,120 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/surlykke/refude/internal/lib/entity"
+	"github.com/surlykke/refude/internal/watch"
+	"golang.org/x/net/websocket"
+)
+
+var things = entity.Register(entity.MakeMap[string, *entity.Base]("/thing/"), entity.SearchOptions{})
+
+type message struct {
+	Id     json.RawMessage `json:"id"`
+	Method string          `json:"method"`
+	Result json.RawMessage `json:"result"`
+	Error  *rpcError       `json:"error"`
+	Params struct {
+		Subscription uint64 `json:"subscription"`
+		Op           string `json:"op"`
+		Path         string `json:"path"`
+	} `json:"params"`
+}
+
+// Routes are registered on http.DefaultServeMux, which allows that only once, so here rather than in each test
+func TestMain(m *testing.M) {
+	things.Serve()
+	Run()
+	watch.Run(context.Background())
+	os.Exit(m.Run())
+}
+
+func dial(t *testing.T) *websocket.Conn {
+	var server = httptest.NewServer(http.DefaultServeMux)
+	t.Cleanup(server.Close)
+	var ws, err = websocket.Dial(strings.Replace(server.URL, "http", "ws", 1)+"/rpc", "", server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ws.Close() })
+	return ws
+}
+
+func call(t *testing.T, ws *websocket.Conn, req string) message {
+	if err := websocket.Message.Send(ws, req); err != nil {
+		t.Fatal(err)
+	}
+	return receive(t, ws)
+}
+
+func receive(t *testing.T, ws *websocket.Conn) message {
+	var msg message
+	ws.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if err := websocket.JSON.Receive(ws, &msg); err != nil {
+		t.Fatal(err)
+	}
+	return msg
+}
+
+func TestRpc(t *testing.T) {
+	t.Cleanup(func() { things.ReplaceAll(map[string]*entity.Base{}) })
+	var ws = dial(t)
+
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 1, "method": "subscribe", "params": {"prefixes": ["/thing/"]}}`); msg.Error != nil || string(msg.Result) != `{"subscription":1}` {
+		t.Errorf("Unexpected response to subscribe: %s, %v", msg.Result, msg.Error)
+	}
+
+	things.Put("a", entity.MakeBase("Alpha", "", "", "Thing"))
+	if msg := receive(t, ws); msg.Method != "event" || msg.Params.Subscription != 1 || msg.Params.Op != "put" || msg.Params.Path != "/thing/a" {
+		t.Errorf("Unexpected event: %v", msg)
+	}
+
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 2, "method": "get", "params": {"path": "/thing/a"}}`); msg.Error != nil || !strings.Contains(string(msg.Result), `"title":"Alpha"`) {
+		t.Errorf("Unexpected response to get: %s, %v", msg.Result, msg.Error)
+	}
+
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 3, "method": "get", "params": {"path": "/thing/b"}}`); msg.Error == nil || msg.Error.Code != http.StatusNotFound {
+		t.Errorf("Expected not found, got %v", msg.Error)
+	}
+
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 4, "method": "invoke", "params": {"path": "/thing/a"}}`); msg.Error == nil || msg.Error.Code != http.StatusMethodNotAllowed {
+		t.Errorf("Expected not allowed, got %v", msg.Error)
+	}
+
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": "five", "method": "search", "params": {"term": "alp"}}`); msg.Error != nil || string(msg.Id) != `"five"` || !strings.Contains(string(msg.Result), `"/thing/a"`) {
+		t.Errorf("Unexpected response to search: %s, %s, %v", msg.Id, msg.Result, msg.Error)
+	}
+
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 6, "method": "unsubscribe", "params": {"subscription": 1}}`); msg.Error != nil || string(msg.Result) != "true" {
+		t.Errorf("Unexpected response to unsubscribe: %s, %v", msg.Result, msg.Error)
+	}
+
+	// No event now, so the next message is the response
+	things.Put("b", entity.MakeBase("Beta", "", "", "Thing"))
+	if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 7, "method": "frobnicate"}`); msg.Error == nil || msg.Error.Code != methodNotFound {
+		t.Errorf("Expected method not found, got %v", msg)
+	}
+
+	for _, path := range []string{"/watch", "/rpc", "/%77atch", "/batch"} {
+		if msg := call(t, ws, `{"jsonrpc": "2.0", "id": 8, "method": "get", "params": {"path": "`+path+`"}}`); msg.Error == nil || msg.Error.Code != http.StatusNotFound {
+			t.Errorf("Expected not found for %s, got %v", path, msg)
+		}
+	}
+
+	if msg := call(t, ws, `not json`); msg.Error == nil || msg.Error.Code != parseError || string(msg.Id) != "null" {
+		t.Errorf("Expected parse error, got %v", msg)
+	}
+}
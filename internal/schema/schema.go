@@ -0,0 +1,283 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package schema
+
+import (
+	"encoding/json"
+	"net/http"
+	"path"
+	"reflect"
+	"strings"
+	"time"
+
+	"github.com/surlykke/refude/internal/config"
+	"github.com/surlykke/refude/internal/health"
+	"github.com/surlykke/refude/internal/lib/entity"
+	"github.com/surlykke/refude/internal/lib/respond"
+)
+
+/*
+ * Serves an OpenAPI 3.1 description of the api at /schema. Entity schemas are derived, by reflection, from
+ * the types held by the registered entity maps. Types that marshal themselves to json should implement
+ * Provider, or they will be described as 'anything'.
+ */
+type Provider interface {
+	JSONSchema() map[string]any
+}
+
+func Run() {
+	http.HandleFunc("GET /schema", func(w http.ResponseWriter, r *http.Request) {
+		respond.AsJson(w, Build())
+	})
+}
+
+type object = map[string]any
+
+func Build() object {
+	var b = builder{defs: make(object)}
+	var paths = object{}
+
+	for _, reg := range entity.Registered() {
+		var entityType = reg.GetEntityType()
+		var ref = b.schemaOf(entityType)
+		var prefix = reg.GetPrefix()
+
+		paths[prefix] = object{
+			"get": object{
+				"summary":    "List " + prefix,
+				"parameters": collectionParameters,
+				"responses":  object{"200": jsonContent("Entities", object{"type": "array", "items": ref})},
+			},
+		}
+
+		var operations = object{
+			"parameters": []object{{"name": "id", "in": "path", "required": true, "schema": object{"type": "string"}}},
+			"get": object{
+				"responses": object{"200": jsonContent("The entity", ref), "404": problemResponse},
+			},
+		}
+		if implements[entity.Postable](entityType) {
+			operations["post"] = object{
+				"summary": "Perform an action. Available actions are given as links with rel '" + entity.OrgRefudeAction + "'",
+				"parameters": []object{
+					{"name": "action", "in": "query", "schema": object{"type": "string"}},
+					ifMatchParameter,
+				},
+				"requestBody": object{"content": object{
+					"application/json":                  object{"schema": object{"oneOf": []object{{"type": "string"}, {"type": "array", "items": object{"type": "string"}}}}},
+					"application/x-www-form-urlencoded": object{"schema": object{"type": "object", "properties": object{"arg": object{"type": "array", "items": object{"type": "string"}}}}},
+				}},
+				"responses": errorResponses("202", "404", "412", "422", "500"),
+			}
+		}
+		if implements[entity.Patchable](entityType) {
+			operations["patch"] = object{
+				"summary":     "Change fields of the entity",
+				"parameters":  []object{ifMatchParameter},
+				"requestBody": object{"content": object{"application/merge-patch+json": object{"schema": object{"type": "object"}}}},
+				"responses":   errorResponses("202", "404", "412", "422", "500"),
+			}
+		}
+		if implements[entity.Deleteable](entityType) {
+			operations["delete"] = object{
+				"parameters": []object{ifMatchParameter},
+				"responses":  errorResponses("202", "404", "412", "500"),
+			}
+		}
+		paths[prefix+"{id}"] = operations
+	}
+
+	for path, operations := range otherPaths {
+		paths[path] = operations
+	}
+
+	b.schemaOf(reflect.TypeFor[respond.Problem]())
+	b.schemaOf(reflect.TypeFor[health.Report]())
+	b.schemaOf(reflect.TypeFor[config.Config]())
+
+	return object{
+		"openapi":    "3.1.0",
+		"info":       object{"title": "refude", "version": "1"},
+		"paths":      paths,
+		"components": object{"schemas": b.defs},
+	}
+}
+
+func implements[I any](t reflect.Type) bool {
+	return t.Implements(reflect.TypeFor[I]())
+}
+
+func jsonContent(description string, schema object) object {
+	return object{"description": description, "content": object{"application/vnd.refude+json": object{"schema": schema}}}
+}
+
+var problemResponse = object{
+	"description": "Problem",
+	"content":     object{"application/problem+json": object{"schema": refTo(reflect.TypeFor[respond.Problem]())}},
+}
+
+func errorResponses(success string, statuses ...string) object {
+	var responses = object{success: object{"description": "Accepted"}}
+	for _, status := range statuses {
+		responses[status] = problemResponse
+	}
+	return responses
+}
+
+var ifMatchParameter = object{"name": "If-Match", "in": "header", "schema": object{"type": "string"}}
+
+var collectionParameters = []object{
+	{"name": "type", "in": "query", "schema": object{"type": "array", "items": object{"type": "string"}}},
+	{"name": "q", "in": "query", "schema": object{"type": "string"}},
+	{"name": "sort", "in": "query", "schema": object{"enum": []string{"title", "-title", "subtitle", "-subtitle", "type", "-type", "path", "-path"}}},
+	{"name": "offset", "in": "query", "schema": object{"type": "integer", "minimum": 0}},
+	{"name": "limit", "in": "query", "schema": object{"type": "integer", "minimum": 0}},
+	{"name": "fields", "in": "query", "description": "Comma separated list of fields", "schema": object{"type": "string"}},
+	{"name": "If-None-Match", "in": "header", "schema": object{"type": "string"}},
+}
+
+var otherPaths = object{
+	"/search": object{"get": object{
+		"parameters": []object{{"name": "term", "in": "query", "description": "May contain filters, eg. 'w:' for windows only", "schema": object{"type": "string"}}},
+		"responses":  object{"200": object{"description": "The parsed query, and matching entities, best match first"}},
+	}},
+	"/search/frecency": object{
+		"get": object{"responses": object{"200": object{"description": "Activations recorded per search term and path"}}},
+		"delete": object{
+			"parameters": []object{{"name": "path", "in": "query", "schema": object{"type": "string"}}},
+			"responses":  object{"202": object{"description": "Forgotten, for path or everything"}},
+		},
+	},
+	"/complete": object{"get": object{
+		"parameters": []object{{"name": "prefix", "in": "query", "schema": object{"type": "string"}}},
+		"responses":  object{"200": jsonContent("Paths starting with prefix", object{"type": "array", "items": object{"type": "string"}})},
+	}},
+	"/watch": object{"get": object{
+		"parameters": []object{
+			{"name": "since", "in": "query", "schema": object{"type": "integer"}},
+			{"name": "prefix", "in": "query", "schema": object{"type": "array", "items": object{"type": "string"}}, "explode": true},
+			{"name": "Last-Event-ID", "in": "header", "schema": object{"type": "integer"}},
+		},
+		"responses": object{"200": object{"description": "Server-sent events", "content": object{"text/event-stream": object{}}}},
+	}},
+	"/rpc": object{"get": object{
+		"description": "Websocket speaking json-rpc 2.0, with methods get, invoke, delete, search, subscribe and unsubscribe",
+		"responses":   object{"101": object{"description": "Switching to websocket"}},
+	}},
+	"/batch": object{"post": object{
+		"parameters": []object{{"name": "stopOnError", "in": "query", "schema": object{"type": "boolean"}}},
+		"responses":  object{"200": object{"description": "Outcome of each operation"}, "422": problemResponse},
+	}},
+	"/health": object{"get": object{
+		"responses": object{"200": jsonContent("State of each subsystem", object{"type": "array", "items": refTo(reflect.TypeFor[health.Report]())})},
+	}},
+	"/config": object{"get": object{
+		"responses": object{"200": jsonContent("The configuration in effect", refTo(reflect.TypeFor[config.Config]()))},
+	}},
+	"/icon": object{"get": object{
+		"parameters": []object{
+			{"name": "name", "in": "query", "required": true, "schema": object{"type": "string"}},
+			{"name": "size", "in": "query", "schema": object{"type": "integer"}},
+		},
+		"responses": object{"200": object{"description": "Icon image"}, "404": problemResponse},
+	}},
+}
+
+type builder struct {
+	defs object
+}
+
+var (
+	providerType  = reflect.TypeFor[Provider]()
+	marshalerType = reflect.TypeFor[json.Marshaler]()
+	timeType      = reflect.TypeFor[time.Time]()
+)
+
+func (this *builder) schemaOf(t reflect.Type) object {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	// JSONSchema is called on a zero value, or a pointer to one, never on nil
+	if t.Implements(providerType) {
+		return reflect.Zero(t).Interface().(Provider).JSONSchema()
+	} else if reflect.PointerTo(t).Implements(providerType) {
+		return reflect.New(t).Interface().(Provider).JSONSchema()
+	} else if t == timeType {
+		return object{"type": "string", "format": "date-time"}
+	} else if t.Implements(marshalerType) || reflect.PointerTo(t).Implements(marshalerType) {
+		return object{}
+	}
+
+	switch t.Kind() {
+	case reflect.Bool:
+		return object{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return object{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return object{"type": "number"}
+	case reflect.String:
+		return object{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			return object{"type": "string", "contentEncoding": "base64"}
+		}
+		return object{"type": "array", "items": this.schemaOf(t.Elem())}
+	case reflect.Map:
+		return object{"type": "object", "additionalProperties": this.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return this.structSchema(t)
+		}
+		var name = defName(t)
+		if _, ok := this.defs[name]; !ok {
+			this.defs[name] = object{} // Placeholder, in case t refers to itself
+			this.defs[name] = this.structSchema(t)
+		}
+		return refTo(t)
+	default:
+		return object{}
+	}
+}
+
+// Qualified by package, as types in different packages may have the same name, eg. 'wayland.Window'
+func defName(t reflect.Type) string {
+	return path.Base(t.PkgPath()) + "." + t.Name()
+}
+
+func refTo(t reflect.Type) object {
+	return object{"$ref": "#/components/schemas/" + defName(t)}
+}
+
+func (this *builder) structSchema(t reflect.Type) object {
+	var properties = object{}
+	var required = []string{}
+	this.collectFields(t, properties, &required)
+	return object{"type": "object", "properties": properties, "required": required}
+}
+
+// Follows encoding/json: embedded structs without a json name have their fields promoted
+func (this *builder) collectFields(t reflect.Type, properties object, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		var field = t.Field(i)
+		var name, opts, _ = strings.Cut(field.Tag.Get("json"), ",")
+		if name == "-" && opts == "" {
+			continue
+		} else if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			this.collectFields(field.Type, properties, required)
+			continue
+		} else if !field.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		properties[name] = this.schemaOf(field.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
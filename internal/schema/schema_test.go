@@ -0,0 +1,47 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package schema
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/surlykke/refude/internal/lib/respond"
+)
+
+type level struct {
+	max int
+}
+
+// Dereferences its receiver, so must not be called on nil
+func (this *level) JSONSchema() map[string]any {
+	return object{"type": "integer", "maximum": this.max}
+}
+
+// Same name as respond.Problem
+type Problem struct {
+	Level *level
+	Other respond.Problem
+}
+
+func TestSchemaOf(t *testing.T) {
+	var b = builder{defs: make(object)}
+	if s := b.schemaOf(reflect.TypeFor[*level]()); s["type"] != "integer" {
+		t.Errorf("Expected schema from JSONSchema, got %v", s)
+	}
+
+	var ref = b.schemaOf(reflect.TypeFor[*Problem]())
+	if ref["$ref"] != "#/components/schemas/schema.Problem" {
+		t.Errorf("Unexpected ref: %v", ref)
+	}
+	if _, ok := b.defs["respond.Problem"]; !ok {
+		t.Errorf("Expected respond.Problem beside schema.Problem, got %v", b.defs)
+	}
+	var properties = b.defs["schema.Problem"].(object)["properties"].(object)
+	if properties["Level"].(object)["type"] != "integer" {
+		t.Errorf("Unexpected schema for Level: %v", properties["Level"])
+	}
+}
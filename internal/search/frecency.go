@@ -0,0 +1,229 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package search
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/surlykke/refude/internal/lib/entity"
+	"github.com/surlykke/refude/internal/lib/respond"
+	"github.com/surlykke/refude/internal/lib/utils"
+	"github.com/surlykke/refude/internal/lib/xdg"
+)
+
+/*
+ * Frecency: how often, and how recently, an entity has been activated after searching for a given term.
+ * Each activation adds 1 to the score of (term, path), and the score halves every halfLife.
+ * When searching for a term, activations recorded with terms that the term is a prefix of, or that are a prefix
+ * of the term, count. So, having activated Firefox after typing 'fi', it gets a bonus when typing 'f' or 'fire'.
+ * Activations with no term count for any search.
+ */
+const halfLife = 14 * 24 * time.Hour
+const frecencyWeight = 10         // Bonus per point of score
+const maxFrecencyBonus uint = 100 // Corresponds to a match with 20 gaps
+const forgetBelow = 0.05          // Records with a score below this are dropped when saving
+const saveDelay = 5 * time.Second
+
+var frecencyPath = xdg.CacheHome + "/refude/frecency.json"
+
+type record struct {
+	Term  string    `json:"term"`
+	Path  string    `json:"path"`
+	Count uint      `json:"count"`
+	Last  time.Time `json:"last"`
+	Score float64   `json:"score"` // As of Last
+}
+
+func (this *record) scoreAt(t time.Time) float64 {
+	return this.Score * math.Exp2(-float64(t.Sub(this.Last))/float64(halfLife))
+}
+
+type key struct {
+	term, path string
+}
+
+var history = struct {
+	lock    sync.Mutex
+	records map[key]*record
+}{
+	records: make(map[key]*record),
+}
+
+func activate(term, path string, t time.Time) {
+	term = strings.ToLower(term)
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	var r, ok = history.records[key{term, path}]
+	if !ok {
+		r = &record{Term: term, Path: path}
+		history.records[key{term, path}] = r
+	}
+	r.Score = r.scoreAt(t) + 1
+	r.Count++
+	r.Last = t
+}
+
+// Bonus for each path, given term
+func bonuses(term string, t time.Time) map[string]uint {
+	term = strings.ToLower(term)
+	var scores = make(map[string]float64)
+	history.lock.Lock()
+	for _, r := range history.records {
+		if strings.HasPrefix(r.Term, term) || strings.HasPrefix(term, r.Term) {
+			scores[r.Path] += r.scoreAt(t)
+		}
+	}
+	history.lock.Unlock()
+
+	var result = make(map[string]uint, len(scores))
+	for path, score := range scores {
+		result[path] = min(maxFrecencyBonus, uint(frecencyWeight*score))
+	}
+	return result
+}
+
+// Lower rank is better, so all get maxFrecencyBonus added, and then their bonus subtracted
+func applyFrecency(list []Ranked, term string) {
+	var b = bonuses(term, time.Now())
+	for i := range list {
+		list[i].Rank += maxFrecencyBonus - b[list[i].Path]
+	}
+}
+
+// Sorted by path and term
+func records() []record {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	var list = make([]record, 0, len(history.records))
+	for _, r := range history.records {
+		list = append(list, *r)
+	}
+	slices.SortFunc(list, func(r1, r2 record) int {
+		if c := strings.Compare(r1.Path, r2.Path); c != 0 {
+			return c
+		}
+		return strings.Compare(r1.Term, r2.Term)
+	})
+	return list
+}
+
+// Forgets everything if path is empty
+func forget(path string) {
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	for k := range history.records {
+		if path == "" || k.path == path {
+			delete(history.records, k)
+		}
+	}
+}
+
+func load() {
+	var bytes, err = os.ReadFile(frecencyPath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return
+	} else if err != nil {
+		log.Print("Could not read ", frecencyPath, ": ", err)
+		return
+	}
+	var list []record
+	if err := json.Unmarshal(bytes, &list); err != nil {
+		log.Print("Could not read ", frecencyPath, ": ", err)
+		return
+	}
+	history.lock.Lock()
+	defer history.lock.Unlock()
+	for _, r := range list {
+		history.records[key{r.Term, r.Path}] = &r
+	}
+}
+
+// Written to a temporary file first, so a crash doesn't leave a partial file
+func save() {
+	var now = time.Now()
+	var list = records()
+	list = slices.DeleteFunc(list, func(r record) bool { return r.scoreAt(now) < forgetBelow })
+	if err := os.MkdirAll(filepath.Dir(frecencyPath), 0700); err != nil {
+		log.Print("Could not save frecency: ", err)
+	} else if err := os.WriteFile(frecencyPath+".tmp", respond.ToJson(list), 0600); err != nil {
+		log.Print("Could not save frecency: ", err)
+	} else if err := os.Rename(frecencyPath+".tmp", frecencyPath); err != nil {
+		log.Print("Could not save frecency: ", err)
+	}
+}
+
+var saving = struct {
+	lock  sync.Mutex // Held while saving, so saves don't overlap
+	timer *time.Timer
+}{}
+
+// Saves after saveDelay, so a burst of changes gives one save
+func saveSoon() {
+	saving.lock.Lock()
+	defer saving.lock.Unlock()
+	if saving.timer == nil {
+		saving.timer = time.AfterFunc(saveDelay, savePending)
+	}
+}
+
+func savePending() {
+	saving.lock.Lock()
+	defer saving.lock.Unlock()
+	if saving.timer != nil {
+		saving.timer.Stop()
+		saving.timer = nil
+		save()
+	}
+}
+
+// Saves what hasn't been saved yet
+func Shutdown() {
+	savePending()
+}
+
+func recordActivations() {
+	var subscription = entity.Activations.Subscribe()
+	for {
+		var a, err = subscription.NextContext(context.Background())
+		if err != nil {
+			return
+		}
+		activate(Parse(a.Term).Term, a.Path, time.Now())
+		saveSoon()
+	}
+}
+
+/*
+ * GET /search/frecency lists what has been recorded, with scores as of now. DELETE forgets it,
+ * or, with query parameter path, what was recorded for that path.
+ */
+func serveFrecency() {
+	http.HandleFunc("GET /search/frecency", func(w http.ResponseWriter, r *http.Request) {
+		var now = time.Now()
+		var list = records()
+		for i := range list {
+			list[i].Score = list[i].scoreAt(now)
+		}
+		respond.AsJson(w, list)
+	})
+	http.HandleFunc("DELETE /search/frecency", func(w http.ResponseWriter, r *http.Request) {
+		forget(utils.QueryParam(r, "path"))
+		saveSoon()
+		respond.Accepted(w)
+	})
+}
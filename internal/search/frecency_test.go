@@ -0,0 +1,81 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package search
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/surlykke/refude/internal/lib/entity"
+)
+
+func TestFrecency(t *testing.T) {
+	defer forget("")
+	var now = time.Now()
+
+	activate("Fi", "/application/firefox", now.Add(-halfLife))
+	activate("fi", "/application/firefox", now)
+	activate("", "/application/files", now)
+
+	var b = bonuses("f", now)
+	if b["/application/firefox"] != uint(frecencyWeight*1.5) {
+		t.Errorf("Expected %d for firefox, got %d", uint(frecencyWeight*1.5), b["/application/firefox"])
+	}
+	if b["/application/files"] != frecencyWeight {
+		t.Errorf("Expected %d for files, got %d", frecencyWeight, b["/application/files"])
+	}
+	if b = bonuses("fire", now); b["/application/firefox"] == 0 {
+		t.Error("Activations after 'fi' should count when searching for 'fire'")
+	}
+	if b = bonuses("x", now); b["/application/firefox"] != 0 {
+		t.Error("Activations after 'fi' should not count when searching for 'x'")
+	}
+
+	for range 100 {
+		activate("fi", "/application/firefox", now)
+	}
+	if b = bonuses("fi", now); b["/application/firefox"] != maxFrecencyBonus {
+		t.Errorf("Expected bonus capped at %d, got %d", maxFrecencyBonus, b["/application/firefox"])
+	}
+
+	var list = []Ranked{
+		{Base: entity.Base{Title: "Files", Path: "/application/files"}, Rank: 0},
+		{Base: entity.Base{Title: "Firefox", Path: "/application/firefox"}, Rank: 0},
+	}
+	applyFrecency(list, "fi")
+	sort(list)
+	if list[0].Title != "Firefox" {
+		t.Errorf("Expected Firefox first, got %v", list)
+	}
+
+	forget("/application/firefox")
+	if b = bonuses("fi", now); b["/application/firefox"] != 0 || b["/application/files"] == 0 {
+		t.Errorf("Expected only firefox forgotten, got %v", b)
+	}
+}
+
+func TestSaveSoon(t *testing.T) {
+	defer forget("")
+	var oldPath = frecencyPath
+	frecencyPath = t.TempDir() + "/frecency.json"
+	defer func() { frecencyPath = oldPath }()
+
+	activate("fi", "/application/firefox", time.Now())
+	saveSoon()
+	saveSoon()
+	if _, err := os.Stat(frecencyPath); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("Expected save delayed, got %v", err)
+	}
+	Shutdown()
+	if _, err := os.Stat(frecencyPath); err != nil {
+		t.Errorf("Expected saved on shutdown, got %v", err)
+	}
+	if saving.timer != nil {
+		t.Error("Expected nothing pending after shutdown")
+	}
+}
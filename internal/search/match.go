@@ -6,105 +6,170 @@
 package search
 
 import (
-	"strings"
+	"math"
+	"slices"
+
+	"github.com/surlykke/refude/internal/lib/fold"
 )
 
-/* Given a text (could be a resource title) and a term (what the user types to search for),
-* we look for shortest possible substrings containing the runes of term in the order the appear in term.
-* So if we search for 'abc'
-*
-*    in                  it should yield   at position
-*    'a very big cat'    'a very big c'    0
-*    'abcabcabc'         'abc'             0, 3 and 6
-*    'aaaaabbbbcccc'     'abbbbc'          4
-*    'fgabhiabjkclmn'    'abjkc'           6
+/*
+* Given a text (could be a resource title) and a term (what the user types to search for), we look for the runes
+* of term in text, in the order they appear in term, and choose the occurrence that costs the least:
 *
-* We can do that with a regular expression like `a[^a]* b[^c]* c`, where the terms `[^a]* ` and `[^c]'` will
-* make the matched subtring start at the latest possible point and  at the earliest possible point.
+*   - the position of the first rune, plus notAtWordStart if it doesn't start a word or camelCase hump
+*   - for each gap between matched runes, gapCost per rune skipped, or gapToWordCost if the rune after the
+*     gap starts a word
 *
-* If we search for a longer term, eg. 'abcd' the regexp would be: `a[^a]* b.* c[^d]* d`
-* If we search for a term of length 2, eg. 'ab', it's: `a[^a]* [^b]* b`
-*
-* We do not use regexp for this, but rather a function coded specifically for these types of regular expressions.
+* So if we search for 'abc'
 *
-* function findMatches implements that. Given a term of length, say 4, eg 'abcd' it maintains an array, 'state' of length 3 of integers.
+*    in                  it should yield   at position   costing
+*    'abcabcabc'         'abc'             0             0
+*    'fffababcggg'       'abc'             5             5 + 10
+*    'a very big cat'    'a.....b...c'     0             6 + 3
+*    'fgabhiabjkclmn'    'ab..c'           6             6 + 10 + 2*5
 *
-* If, say, state[1] == 7, that means that we have a potential match starting at textpos 7, and have so far read 'a' and 'b'. If we then encounter
-* 'c' we set state[1] = -1 and state[2] = 7.
+* and 'gc' finds 'Google Chrome' (cost 6) before 'logcat' (cost 12).
 *
-*  As another example lets search for 'abc' in 'fffababcggg'. As we read through 'fffababcggg', state will evolve as:
-* Text position         letter read    match   state
-*             0                   f            [-1, -1]
-*             1                   f            [-1, -1]
-*             2                   f            [-1, -1]
-*             3                   a            [ 3, -1]
-*             4                   b            [-1,  3]
-*             5                   a            [ 5,  3]
-*             6                   b            [-1,  5]
-*             7                   c    [5:8]   [-1, -1]
-*             8                   g            [-1, -1]
-*             9                   g            [-1, -1]
-*            10                   g            [-1, -1]
+* The cheapest occurrence is found by dynamic programming: For each rune of the term, in turn, and each position
+* in text holding that rune, we find the cheapest way to match the term up to and including that rune, ending
+* there. As the cost of a gap is linear in its length, with a factor depending only on where it ends, this can be
+* done in one pass over the text per rune of the term.
 *
+* Text and term are folded (see package fold) before matching. Positions are rune positions, and spans returned refer to
+* the runes of the original text.
  */
 
 type matcher struct {
-	term      []rune
-	curstate  []int
-	nextstate []int
+	term []rune
 }
 
 func makeMatcher(term string) matcher {
-	var m = matcher{term: []rune(strings.ToLower(term))}
-	if len(term) > 1 {
-		m.curstate = make([]int, len(m.term)-1)
-		m.nextstate = make([]int, len(m.term)-1)
-	}
-	return m
+	return matcher{term: fold.Fold(term).Runes}
+}
+
+// Runes start to end (exclusive) of a text
+type Span struct {
+	Start int `json:"start"`
+	End   int `json:"end"`
 }
 
+const (
+	notAtWordStart = 10 // Added when the match doesn't start at a word
+	gapCost        = 5  // Per rune skipped between matched runes
+	gapToWordCost  = 1  // Per rune skipped, when the next matched rune starts a word
+)
+
 func (this matcher) match(text string) uint {
-	text = strings.ToLower(text)
-	switch len(this.term) {
-	case 0:
-		return 0
-	case 1:
-		for pos, r := range text {
-			if this.term[0] == r {
-				return uint(pos)
-			}
-		}
-		return maxRank
-	default:
-		var res = maxRank
+	var rank, _ = this.matchSpans(text)
+	return rank
+}
 
-		for i := range this.curstate {
-			this.curstate[i] = -1
-		}
+// Returns the rank of the best match in text, and the runes of text that make it up, as spans.
+// If there is no match the rank is maxRank, and spans nil.
+func (this matcher) matchSpans(text string) (uint, []Span) {
+	return this.matchFolded(fold.Fold(text))
+}
 
-		for textpos, r := range text {
-			if r == this.term[0] {
-				this.nextstate[0] = textpos
-			} else {
-				this.nextstate[0] = this.curstate[0]
+// As matchSpans, for a text already folded
+func (this matcher) matchFolded(f fold.Folded) (uint, []Span) {
+	if len(this.term) == 0 {
+		return 0, nil
+	}
+	var n = len(f.Runes)
+	if n < len(this.term) || !this.within(f.Runes) {
+		return maxRank, nil
+	}
+
+	const none = math.MaxInt
+	// costs[p]: least cost of matching the term so far, with the current rune at p. none if not possible.
+	// parents[i][p]: where term[i-1] is matched in that
+	var costs = make([]int, n)
+	var parents = make([][]int, len(this.term))
+	for p, r := range f.Runes {
+		costs[p] = none
+		if r == this.term[0] {
+			costs[p] = p
+			if !f.Boundary[p] {
+				costs[p] += notAtWordStart
 			}
-			for i := 1; i < len(this.term)-1; i++ {
-				if this.term[i] == r && this.curstate[i-1] > -1 {
-					this.nextstate[i], this.nextstate[i-1] = this.curstate[i-1], -1
-				} else {
-					this.nextstate[i] = this.curstate[i]
+		}
+	}
+
+	var next = make([]int, n)
+	for i := 1; i < len(this.term); i++ {
+		parents[i] = make([]int, n)
+		// Over q < p: the least of costs[q] - q*gapToWordCost and of costs[q] - q*gapCost, and where
+		var toWordMin, toWordAt, otherMin, otherAt = none, -1, none, -1
+		for p, r := range f.Runes {
+			next[p] = none
+			if r == this.term[i] {
+				if f.Boundary[p] && toWordAt > -1 {
+					next[p], parents[i][p] = toWordMin+(p-1)*gapToWordCost, toWordAt
+				} else if !f.Boundary[p] && otherAt > -1 {
+					next[p], parents[i][p] = otherMin+(p-1)*gapCost, otherAt
 				}
 			}
-			if this.term[len(this.term)-1] == r && this.curstate[len(this.term)-2] > -1 {
-				var start, end = this.curstate[len(this.term)-2], textpos + 1
-				var tmp = uint(start + 5*(end-start-len(this.term)))
-				if tmp < res {
-					res = tmp
+			if costs[p] != none {
+				if c := costs[p] - p*gapToWordCost; c < toWordMin {
+					toWordMin, toWordAt = c, p
+				}
+				if c := costs[p] - p*gapCost; c < otherMin {
+					otherMin, otherAt = c, p
 				}
-				this.nextstate[len(this.term)-2] = -1
 			}
-			this.curstate, this.nextstate = this.nextstate, this.curstate
 		}
-		return res
+		costs, next = next, costs
+	}
+
+	var best, end = none, -1
+	for p, c := range costs {
+		if c < best {
+			best, end = c, p
+		}
+	}
+	if end < 0 {
+		return maxRank, nil
+	}
+
+	var positions = make([]int, len(this.term))
+	positions[len(this.term)-1] = end
+	for i := len(this.term) - 1; i > 0; i-- {
+		positions[i-1] = parents[i][positions[i]]
+	}
+	return uint(best), spans(f, positions)
+}
+
+// Whether the runes of term occur in runes, in order. Cheap, so most texts that don't match are rejected
+// before setting up for the search for the best match
+func (this matcher) within(runes []rune) bool {
+	var i = 0
+	for _, r := range runes {
+		if r == this.term[i] {
+			if i++; i == len(this.term) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Matched runes, as spans of the original text. Runes that came from the same original rune count once
+func spans(f fold.Folded, positions []int) []Span {
+	if positions == nil {
+		return nil
+	}
+	var result = make([]Span, 0, len(positions))
+	for _, pos := range positions {
+		var o = f.Origin[pos]
+		if len(result) == 0 {
+			result = append(result, Span{o, o + 1})
+		} else if last := &result[len(result)-1]; o < last.End {
+			continue
+		} else if o == last.End {
+			last.End++
+		} else {
+			result = append(result, Span{o, o + 1})
+		}
 	}
+	return slices.Clip(result)
 }
@@ -1,9 +1,148 @@
 package search
 
-import "testing"
+import (
+	"reflect"
+	"testing"
+
+	"github.com/surlykke/refude/internal/lib/entity"
+)
 
 func TestMatch(t *testing.T) {
 	var matcher = makeMatcher("abc")
-	var text = "fffababcggg"
-	matcher.match(text)
+	if rank := matcher.match("fffababcggg"); rank != 5+notAtWordStart {
+		t.Errorf("Expected %d, got %d", 5+notAtWordStart, rank)
+	}
+}
+
+func TestMatchSpans(t *testing.T) {
+	var tests = []struct {
+		term, text string
+		rank       uint
+		spans      []Span
+	}{
+		// Plain ascii
+		{"abc", "fffababcggg", 5 + notAtWordStart, []Span{{5, 8}}},
+		{"abc", "abcabcabc", 0, []Span{{0, 3}}},
+		{"abc", "aaaaabbbbcccc", 4 + notAtWordStart + 3*gapCost, []Span{{4, 6}, {9, 10}}},
+		{"abc", "a very big cat", 6*gapToWordCost + 3*gapToWordCost, []Span{{0, 1}, {7, 8}, {11, 12}}},
+		{"abc", "fgabhiabjkclmn", 6 + notAtWordStart + 2*gapCost, []Span{{6, 8}, {10, 11}}},
+		{"f", "Firefox", 0, []Span{{0, 1}}},
+		{"fox", "Firefox", 4 + notAtWordStart, []Span{{4, 7}}},
+		{"FOX", "firefox", 4 + notAtWordStart, []Span{{4, 7}}},
+		{"xyz", "Firefox", maxRank, nil},
+		{"ff", "f", maxRank, nil},
+		{"", "Firefox", 0, nil},
+		{"a", "", maxRank, nil},
+
+		// Single rune terms prefer word starts over earlier positions
+		{"c", "Arc Chrome", 4, []Span{{4, 5}}},
+		{"c", "arcade", 2 + notAtWordStart, []Span{{2, 3}}},
+
+		// Word starts, camelCase humps and digits
+		{"mf", "Mozilla Firefox", 7 * gapToWordCost, []Span{{0, 1}, {8, 9}}},
+		{"bs", "BookmarkStore", 7 * gapToWordCost, []Span{{0, 1}, {8, 9}}},
+		{"2", "Document2", 8, []Span{{8, 9}}},
+		{"ds", "dev-server", 3 * gapToWordCost, []Span{{0, 1}, {4, 5}}},
+		{"hs", "HTTPServer", 3 * gapToWordCost, []Span{{0, 1}, {4, 5}}},
+
+		// Diacritics and other foldings
+		{"cafe", "Café", 0, []Span{{0, 4}}},
+		{"café", "Cafe", 0, []Span{{0, 4}}},
+		{"uber", "Über", 0, []Span{{0, 4}}},
+		{"ae", "Æble", 0, []Span{{0, 1}}},
+		{"aeble", "Æble", 0, []Span{{0, 4}}},
+		{"b", "Æble", 2 + notAtWordStart, []Span{{1, 2}}},
+		{"strasse", "Straße", 0, []Span{{0, 6}}},
+		{"ore", "Øre", 0, []Span{{0, 3}}},
+		{"file", "ﬁle", 0, []Span{{0, 3}}},
+		{"abc", "ＡＢＣ", 0, []Span{{0, 3}}},
+		{"lodz", "Łódź", 0, []Span{{0, 4}}},
+		{"nino", "Niño", 0, []Span{{0, 4}}},
+
+		// Multi-byte text is indexed by rune
+		{"日本", "こんにちは日本", 5 + notAtWordStart, []Span{{5, 7}}},
+		{"x", "ééééx", 4 + notAtWordStart, []Span{{4, 5}}},
+		{"éx", "aéééx", 3 + notAtWordStart, []Span{{3, 5}}},
+	}
+	for _, test := range tests {
+		var rank, spans = makeMatcher(test.term).matchSpans(test.text)
+		if rank != test.rank || !reflect.DeepEqual(spans, test.spans) {
+			t.Errorf("'%s' in '%s': expected %d, %v, got %d, %v", test.term, test.text, test.rank, test.spans, rank, spans)
+		}
+	}
+}
+
+// For each term, the texts should rank in the order given
+func TestRankOrder(t *testing.T) {
+	var tests = []struct {
+		term  string
+		texts []string
+	}{
+		{"fire", []string{"Firefox", "Mozilla Firefox", "Campfire"}},
+		{"gc", []string{"Google Chrome", "logcat"}},
+		{"term", []string{"Terminal", "GNOME Terminal", "Determine"}},
+		{"vsc", []string{"vscode-helper", "Visual Studio Code"}},
+		{"cafe", []string{"Café", "Internet café", "Acafe"}},
+		{"hs", []string{"HTTPServer", "Hostname"}},
+	}
+	for _, test := range tests {
+		var m = makeMatcher(test.term)
+		for i := 1; i < len(test.texts); i++ {
+			if r1, r2 := m.match(test.texts[i-1]), m.match(test.texts[i]); r1 >= r2 {
+				t.Errorf("'%s': expected '%s' (%d) before '%s' (%d)", test.term, test.texts[i-1], r1, test.texts[i], r2)
+			}
+		}
+	}
+}
+
+func TestFilterMatch(t *testing.T) {
+	var m = entity.MakeMap[int, *entity.Base]("/test/")
+	m.Put(1, entity.MakeBase("Firefox", "", "", "Application", "browser", "web"))
+	m.Put(2, entity.MakeBase("Files", "", "", "Application"))
+	m.Put(3, entity.MakeBase("Terminal", "", "", "Application"))
+	var entries = m.GetSearchEntries()
+	var ranked = filter(entries, makeMatcher("web"), Query{})
+	if len(ranked) != 1 || ranked[0].Title != "Firefox" {
+		t.Fatalf("Expected Firefox, got %v", ranked)
+	}
+	if m := ranked[0].Match; m == nil || m.Field != "keyword" || m.Keyword != "web" || !reflect.DeepEqual(m.Spans, []Span{{0, 3}}) {
+		t.Errorf("Unexpected match: %+v", m)
+	}
+
+	ranked = filter(entries, makeMatcher("fi"), Query{})
+	if len(ranked) != 2 {
+		t.Fatalf("Expected 2 results, got %v", ranked)
+	}
+	for _, r := range ranked {
+		if r.Match == nil || r.Match.Field != "title" || !reflect.DeepEqual(r.Match.Spans, []Span{{0, 2}}) {
+			t.Errorf("Unexpected match for %s: %+v", r.Title, r.Match)
+		}
+	}
+
+	if ranked = filter(entries, makeMatcher(""), Query{}); len(ranked) != 3 || ranked[0].Match != nil {
+		t.Errorf("Empty term should give all, without match, got %v", ranked)
+	}
+}
+
+// Spans should be ordered, non-empty, non-overlapping and within the text, and cover at most as many runes as the term
+func FuzzMatchSpans(f *testing.F) {
+	for _, seed := range [][2]string{{"abc", "a very big cat"}, {"ae", "Æble"}, {"cafe", "Internet Café"}, {"日本", "こんにちは日本"}, {"ss", "Straße"}} {
+		f.Add(seed[0], seed[1])
+	}
+	f.Fuzz(func(t *testing.T, term, text string) {
+		var rank, spans = makeMatcher(term).matchSpans(text)
+		if rank >= maxRank || spans == nil {
+			return
+		}
+		var runeCount, covered, prevEnd = len([]rune(text)), 0, 0
+		for _, s := range spans {
+			if s.Start < prevEnd || s.End <= s.Start || s.End > runeCount {
+				t.Fatalf("'%s' in '%s': bad spans %v", term, text, spans)
+			}
+			covered, prevEnd = covered+s.End-s.Start, s.End
+		}
+		if covered > len(makeMatcher(term).term) {
+			t.Fatalf("'%s' in '%s': spans %v cover more runes than the term has", term, text, spans)
+		}
+	})
 }
@@ -0,0 +1,91 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package search
+
+import (
+	"slices"
+	"strings"
+)
+
+/*
+ * What is searched for is given as words, separated by space. A word that is a filter narrows the search to
+ * entities of some kinds:
+ *
+ *   w:  windows          a:  applications     n:  notifications
+ *   t:  browser tabs     f:  files
+ *
+ * A filter may be joined with the start of the term, so 'w:fire' and 'w: fire' are the same.
+ * With more than one filter, entities of any of the kinds are found. A filter preceded by '!', eg. '!n:', excludes
+ * that kind instead. Any other word preceded by '!' excludes entities with that in their title.
+ * The remaining words, joined by single spaces, make up the term.
+ *
+ * With a filter, collections are searched regardless of their minimum term length.
+ */
+var filters = map[string]string{
+	"w": "Window",
+	"t": "Browser tab",
+	"a": "Application",
+	"f": "File",
+	"n": "Notification",
+}
+
+type Query struct {
+	Term    string   `json:"term"`
+	Kinds   []string `json:"kinds,omitempty"`   // Only entities of these kinds. All if empty
+	Exclude []string `json:"exclude,omitempty"` // Not entities of these kinds
+	Without []string `json:"without,omitempty"` // Not entities with one of these in their title (lowercased)
+}
+
+func Parse(input string) Query {
+	var q Query
+	var words = make([]string, 0, 4)
+	for _, word := range strings.Fields(input) {
+		var excluding = false
+		var w = word
+		if len(w) > 1 && w[0] == '!' {
+			excluding, w = true, w[1:]
+		}
+		if name, rest, found := strings.Cut(w, ":"); found && filters[name] != "" {
+			if excluding {
+				q.Exclude = appendNew(q.Exclude, filters[name])
+			} else {
+				q.Kinds = appendNew(q.Kinds, filters[name])
+			}
+			if rest != "" {
+				words = append(words, rest)
+			}
+		} else if excluding {
+			q.Without = appendNew(q.Without, strings.ToLower(w))
+		} else {
+			words = append(words, word)
+		}
+	}
+	q.Term = strings.Join(words, " ")
+	return q
+}
+
+func appendNew(list []string, s string) []string {
+	if slices.Contains(list, s) {
+		return list
+	}
+	return append(list, s)
+}
+
+func (this Query) filtered() bool {
+	return len(this.Kinds) > 0
+}
+
+func (this Query) accepts(kind string, title string) bool {
+	if len(this.Kinds) > 0 && !slices.Contains(this.Kinds, kind) {
+		return false
+	} else if slices.Contains(this.Exclude, kind) {
+		return false
+	} else if len(this.Without) == 0 {
+		return true
+	}
+	var lowerTitle = strings.ToLower(title)
+	return !slices.ContainsFunc(this.Without, func(w string) bool { return strings.Contains(lowerTitle, w) })
+}
@@ -0,0 +1,39 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package search
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	var tests = []struct {
+		input    string
+		expected Query
+	}{
+		{"", Query{}},
+		{"fire fox", Query{Term: "fire fox"}},
+		{"w:fire", Query{Term: "fire", Kinds: []string{"Window"}}},
+		{"w: t:  fire", Query{Term: "fire", Kinds: []string{"Window", "Browser tab"}}},
+		{"fire !n:", Query{Term: "fire", Exclude: []string{"Notification"}}},
+		{"fire !Fox", Query{Term: "fire", Without: []string{"fox"}}},
+		{"x:y !", Query{Term: "x:y !"}},
+		{"a:gimp a:", Query{Term: "gimp", Kinds: []string{"Application"}}},
+	}
+	for _, test := range tests {
+		if q := Parse(test.input); !reflect.DeepEqual(q, test.expected) {
+			t.Errorf("Parse(%q): expected %+v, got %+v", test.input, test.expected, q)
+		}
+	}
+}
+
+func TestAccepts(t *testing.T) {
+	var q = Parse("w: t: !fox")
+	if !q.accepts("Window", "Terminal") || q.accepts("Window", "Firefox") || q.accepts("Application", "Terminal") {
+		t.Errorf("Unexpected acceptance with %+v", q)
+	}
+}
@@ -9,70 +9,123 @@ import (
 	"net/http"
 	"slices"
 	"strings"
+	"sync"
 
-	"github.com/surlykke/refude/internal/applications"
-	"github.com/surlykke/refude/internal/browser"
-	"github.com/surlykke/refude/internal/desktopactions"
-	"github.com/surlykke/refude/internal/file"
-	"github.com/surlykke/refude/internal/icons"
 	"github.com/surlykke/refude/internal/lib/entity"
 	"github.com/surlykke/refude/internal/lib/respond"
 	"github.com/surlykke/refude/internal/lib/utils"
-	"github.com/surlykke/refude/internal/network"
-	"github.com/surlykke/refude/internal/notifications"
-	"github.com/surlykke/refude/internal/power"
-	"github.com/surlykke/refude/internal/wayland"
 )
 
 func Run() {
 	http.HandleFunc("GET /search", func(w http.ResponseWriter, r *http.Request) {
-		respond.AsJson(w, Search(utils.QueryParam(r, "term")))
+		var q = Parse(utils.QueryParam(r, "term"))
+		respond.AsJson(w, Response{Query: q, Results: SearchQuery(q)})
 	})
+	serveFrecency()
+	load()
+	go recordActivations()
 }
 
 const maxRank uint = 1000000
+const dynamicRank uint = maxRank / 2
 
 type Ranked struct {
 	entity.Base
-	Rank uint `json:"-"`
+	Rank  uint   `json:"rank"`            // Lower is better
+	Match *Match `json:"match,omitempty"` // Nil when the term is empty, or a dynamic result doesn't match it
 }
 
-func Search(term string) []Ranked {
-	var m = makeMatcher(term)
-	var result = make([]Ranked, 0, 1000)
+// Where the term matched, so clients can highlight it
+type Match struct {
+	Field   string `json:"field"`             // "title" or "keyword"
+	Keyword string `json:"keyword,omitempty"` // The keyword matched, if field is "keyword"
+	Spans   []Span `json:"spans"`             // Runes of title or keyword matched
+}
 
-	result = append(result, filter(notifications.NotificationMap.GetForSearch(), m)...)
-	result = append(result, filter(wayland.WindowMap.GetForSearch(), m)...)
-	result = append(result, filter(browser.TabMap.GetForSearch(), m)...)
+// The query as parsed, so clients can show it, and what it found
+type Response struct {
+	Query   Query    `json:"query"`
+	Results []Ranked `json:"results"`
+}
 
-	if len(m.term) > 0 {
-		result = append(result, filter(applications.AppMap.GetForSearch(), m)...)
-	}
-	if len(m.term) > 2 {
-		result = append(result, filter(network.Connections.GetForSearch(), m)...)
-		result = append(result, filter(power.DeviceMap.GetForSearch(), m)...)
-		result = append(result, filter(file.FileMap.GetForSearch(), m)...)
-		result = append(result, filter(browser.BookmarkMap.GetForSearch(), m)...)
-		result = append(result, filter(desktopactions.PowerActions.GetForSearch(), m)...)
+// Searches for input, parsed as described in query.go
+func Search(input string) []Ranked {
+	return SearchQuery(Parse(input))
+}
+
+func SearchQuery(q Query) []Ranked {
+	return searchIn(entity.Registered(), q)
+}
+
+// Each collection is searched in its own goroutine
+func searchIn(regs []entity.Registration, q Query) []Ranked {
+	var m = makeMatcher(q.Term)
+	var found = make([][]Ranked, len(regs))
+	var wg sync.WaitGroup
+
+	for i, reg := range regs {
+		if !reg.Exclude && (q.filtered() || len(m.term) >= reg.MinTermLength) {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				found[i] = filter(reg.GetSearchEntries(), m, q)
+				// Dynamic results are of kinds the filters don't know
+				if searcher, ok := reg.Collection.(entity.DynamicSearcher); ok && !q.filtered() {
+					found[i] = append(found[i], rankDynamic(searcher.SearchFor(q.Term), m, q)...)
+				}
+			}()
+		}
 	}
+	wg.Wait()
 
+	var result = slices.Concat(found...)
+	applyFrecency(result, q.Term)
 	sort(result)
 	return result
 }
 
-func filter(bases []entity.Base, m matcher) []Ranked {
-	var result = make([]Ranked, 0, len(bases))
-	for _, res := range bases {
-		var rankCalculated = m.match(res.Title)
-		for _, keyword := range res.Keywords {
-			if tmp := m.match(keyword) + 20; tmp < rankCalculated {
-				rankCalculated = tmp
+func filter(entries []*entity.SearchEntry, m matcher, q Query) []Ranked {
+	var result = make([]Ranked, 0, len(entries))
+	for _, e := range entries {
+		var res = &e.Base
+		if !q.accepts(res.Kind, res.Title) {
+			continue
+		}
+		var title, keywords = e.Folds()
+		var rankCalculated, spans = m.matchFolded(title)
+		var match = &Match{Field: "title", Spans: spans}
+		for i, keyword := range keywords {
+			if tmp, keywordSpans := m.matchFolded(keyword); tmp+20 < rankCalculated {
+				rankCalculated = tmp + 20
+				match = &Match{Field: "keyword", Keyword: res.Keywords[i], Spans: keywordSpans}
 			}
 		}
 		if rankCalculated < maxRank {
-			result = append(result, Ranked{Base: res, Rank: rankCalculated})
+			if match.Spans == nil {
+				match = nil
+			}
+			result = append(result, Ranked{Base: *res, Rank: rankCalculated, Match: match})
 		}
+	}
+	return result
+}
 
+// Results computed for the term by their provider are kept, even if they don't match it. Those that don't are
+// placed after those that do, in the order the provider gave them.
+func rankDynamic(bases []entity.Base, m matcher, q Query) []Ranked {
+	var result = make([]Ranked, 0, len(bases))
+	for i, res := range bases {
+		if !q.accepts(res.Kind, res.Title) {
+			continue
+		}
+		var rank, spans = m.matchSpans(res.Title)
+		var match *Match
+		if rank >= maxRank {
+			rank = dynamicRank + uint(i)
+		} else if spans != nil {
+			match = &Match{Field: "title", Spans: spans}
+		}
+		result = append(result, Ranked{Base: res, Rank: rank, Match: match})
 	}
 	return result
 }
@@ -90,32 +143,14 @@ func sort(list []Ranked) {
 }
 
 func SearchByPath(path string) (entity.Base, bool) {
-	var bases []entity.Base
-	if strings.HasPrefix(path, "/window/") {
-		bases = wayland.WindowMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/application/") {
-		bases = applications.AppMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/mimetype/") {
-		bases = applications.MimeMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/notification/") {
-		bases = notifications.NotificationMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/icontheme/") {
-		bases = icons.ThemeMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/device/") {
-		bases = power.DeviceMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/tab/") {
-		bases = browser.TabMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/bookmark/") {
-		bases = browser.BookmarkMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/file/") {
-		bases = file.FileMap.GetForSearch()
-	} else if strings.HasPrefix(path, "/start/") {
-		bases = desktopactions.PowerActions.GetForSearch()
+	var entries []*entity.SearchEntry
+	if reg, ok := entity.RegisteredFor(path); ok {
+		entries = reg.GetSearchEntries()
 	}
 
-	for _, b := range bases {
-		if b.Path == path {
-			return b, true
+	for _, e := range entries {
+		if e.Base.Path == path {
+			return e.Base, true
 		}
 	}
 
@@ -0,0 +1,88 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package search
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/surlykke/refude/internal/lib/entity"
+)
+
+var titleWords = []string{"Firefox", "Terminal", "Café", "document", "Straße", "HTTPServer", "notes", "Über", "project", "Chrome"}
+
+// count entities, spread over 10 collections, as search usually has about that many
+func makeRegistrations(count int) []entity.Registration {
+	var regs = make([]entity.Registration, 10)
+	for i := range regs {
+		var m = entity.MakeMap[int, *entity.Base](fmt.Sprintf("/bench%d/", i))
+		for j := i; j < count; j += len(regs) {
+			var title = fmt.Sprintf("%s %s %d", titleWords[j%len(titleWords)], titleWords[(j/len(titleWords))%len(titleWords)], j)
+			m.Put(j, entity.MakeBase(title, "", "", "Test", titleWords[(j+3)%len(titleWords)]))
+		}
+		regs[i] = entity.Registration{Collection: m}
+	}
+	return regs
+}
+
+func TestSearchIn(t *testing.T) {
+	var regs = makeRegistrations(100)
+	var result = searchIn(regs, Parse("cafe"))
+	if len(result) == 0 || result[0].Rank > result[len(result)-1].Rank {
+		t.Fatalf("Expected results, ordered by rank, got %v", result)
+	}
+	if len(searchIn(regs, Parse("xyzzy"))) != 0 {
+		t.Error("Expected no results for 'xyzzy'")
+	}
+	if n := len(searchIn(regs, Parse(""))); n != 100 {
+		t.Errorf("Expected all 100 for the empty term, got %d", n)
+	}
+}
+
+// As search was before the index: every base copied, and title and keywords folded, on each search
+func scan(regs []entity.Registration, q Query) []Ranked {
+	var m = makeMatcher(q.Term)
+	var result = make([]Ranked, 0, 1000)
+	for _, reg := range regs {
+		for _, e := range reg.GetSearchEntries() {
+			var base = e.Base
+			if !q.accepts(base.Kind, base.Title) {
+				continue
+			}
+			var rank, _ = m.matchSpans(base.Title)
+			for _, keyword := range base.Keywords {
+				if tmp, _ := m.matchSpans(keyword); tmp+20 < rank {
+					rank = tmp + 20
+				}
+			}
+			if rank < maxRank {
+				result = append(result, Ranked{Base: base, Rank: rank})
+			}
+		}
+	}
+	sort(result)
+	return result
+}
+
+func BenchmarkSearch(b *testing.B) {
+	defer forget("")
+	for _, count := range []int{1000, 10000, 100000} {
+		var regs = makeRegistrations(count)
+		for _, term := range []string{"f", "cafe", "term doc"} {
+			var q = Parse(term)
+			b.Run(fmt.Sprintf("index/%d/%s", count, term), func(b *testing.B) {
+				for b.Loop() {
+					searchIn(regs, q)
+				}
+			})
+			b.Run(fmt.Sprintf("scan/%d/%s", count, term), func(b *testing.B) {
+				for b.Loop() {
+					scan(regs, q)
+				}
+			})
+		}
+	}
+}
@@ -6,63 +6,214 @@
 package watch
 
 import (
+	"bytes"
+	"context"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
-	"github.com/surlykke/refude/internal/applications"
-	"github.com/surlykke/refude/internal/browser"
-	"github.com/surlykke/refude/internal/file"
 	"github.com/surlykke/refude/internal/lib/entity"
-	"github.com/surlykke/refude/internal/notifications"
-	"github.com/surlykke/refude/internal/power"
-	"github.com/surlykke/refude/internal/wayland"
+	"github.com/surlykke/refude/internal/lib/respond"
+	"github.com/surlykke/refude/internal/lib/utils"
 	"github.com/surlykke/refude/pkg/pubsub"
 )
 
-type event struct {
-	event string
-	data  string
+const replayWindow = 1000
+const heartbeatInterval = 20 * time.Second
+
+// An event with its id in the stream. Id 0 is a heartbeat, not an event
+type NumberedEvent struct {
+	Id uint64
+	entity.Event
+}
+
+var aggregatedEvents = pubsub.MakePublisher[NumberedEvent]()
+
+// The last replayWindow events, so clients reconnecting can catch up.
+// Ids start at server start time in nanoseconds, so an id from a previous run of refude-server
+// will always be older than anything in the journal, and make the client reset.
+var journal = struct {
+	lock   sync.Mutex
+	lastId uint64
+	events []NumberedEvent
+}{
+	lastId: uint64(time.Now().UnixNano()),
+	events: make([]NumberedEvent, 0, replayWindow),
+}
+
+func record(evt entity.Event) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	journal.lastId++
+	var ne = NumberedEvent{Id: journal.lastId, Event: evt}
+	if len(journal.events) == replayWindow {
+		copy(journal.events, journal.events[1:])
+		journal.events = journal.events[:replayWindow-1]
+	}
+	journal.events = append(journal.events, ne)
+	aggregatedEvents.Publish(ne)
+}
+
+// Subscribes and returns the accepted events after since. If those are no longer in the journal, a reset event
+// is returned instead
+func subscribeSince(since uint64, accept func(NumberedEvent) bool) (*pubsub.Subscription[NumberedEvent], []NumberedEvent) {
+	journal.lock.Lock()
+	defer journal.lock.Unlock()
+	var subscription = aggregatedEvents.SubscribeWhere(accept)
+	var oldest = journal.lastId - uint64(len(journal.events)) + 1
+	if since > journal.lastId || since+1 < oldest {
+		return subscription, []NumberedEvent{{Id: journal.lastId, Event: resetEvent}}
+	}
+	var missed = make([]NumberedEvent, 0, len(journal.events))
+	for _, evt := range journal.events[since+1-oldest:] {
+		if accept(evt) {
+			missed = append(missed, evt)
+		}
+	}
+	return subscription, missed
 }
 
-var aggregatedEvents = pubsub.MakePublisher[entity.Event]()
+// Subscribes to events with paths starting with one of prefixes, or all events if none are given.
+// The subscription should be closed when no longer used
+func Subscribe(prefixes []string) (*pubsub.Subscription[NumberedEvent], error) {
+	if err := checkPrefixes(prefixes); err != nil {
+		return nil, err
+	}
+	return aggregatedEvents.SubscribeWhere(acceptor(prefixes)), nil
+}
+
+func checkPrefixes(prefixes []string) error {
+	for _, prefix := range prefixes {
+		if !strings.HasPrefix(prefix, "/") {
+			return fmt.Errorf("prefix '%s' should start with '/'", prefix)
+		}
+	}
+	return nil
+}
+
+/*
+ * Accepts heartbeats, and events with a path starting with one of prefixes. A reset of a map is accepted if any
+ * of the prefixes are within it. No prefixes means everything.
+ */
+func acceptor(prefixes []string) func(NumberedEvent) bool {
+	return func(evt NumberedEvent) bool {
+		if len(prefixes) == 0 || evt.Id == 0 {
+			return true
+		}
+		for _, prefix := range prefixes {
+			if strings.HasPrefix(evt.Path, prefix) || (evt.Op == entity.OpReset && strings.HasPrefix(prefix, evt.Path)) {
+				return true
+			}
+		}
+		return false
+	}
+}
 
-func follow(events *pubsub.Publisher[entity.Event]) {
+func follow(ctx context.Context, events *pubsub.Publisher[entity.Event]) {
 	var subscription = events.Subscribe()
 	for {
-		aggregatedEvents.Publish(subscription.Next())
+		if evt, err := subscription.NextContext(ctx); err != nil {
+			return
+		} else {
+			record(evt)
+		}
+	}
+}
+
+func heartbeat(ctx context.Context) {
+	var ticker = time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			aggregatedEvents.Publish(NumberedEvent{})
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
-func Run() {
+// Events are followed until ctx is done
+func Run(ctx context.Context) {
 	http.HandleFunc("GET /watch", ServeHTTP)
 
-	go follow(applications.AppMap.Events)
-	go follow(applications.MimeMap.Events)
-	go follow(wayland.WindowMap.Events)
-	go follow(notifications.NotificationMap.Events)
-	go follow(browser.BookmarkMap.Events)
-	go follow(browser.TabMap.Events)
-	go follow(power.DeviceMap.Events)
-	go follow(file.FileMap.Events)
+	for _, reg := range entity.Registered() {
+		go follow(ctx, reg.GetEvents())
+	}
+	go heartbeat(ctx)
 }
 
+var resetEvent = entity.Event{Event: "reset", Op: entity.OpReset, Path: "/"}
+
+/*
+ * Streams events as server-sent events. A client reconnecting may give the id of the last event it saw
+ * in header Last-Event-ID (EventSource does that automatically) or query parameter since. It will then
+ * get the events it missed, or, if they are no longer available, a reset event.
+ * Query parameter prefix, which may be given more than once, limits the stream to events with paths
+ * starting with one of them, eg. '/watch?prefix=/notification/&prefix=/window/'.
+ */
 func ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var subscription = aggregatedEvents.Subscribe()
+	var subscription *pubsub.Subscription[NumberedEvent]
+	var missed []NumberedEvent
+
+	var prefixes = r.URL.Query()["prefix"]
+	if err := checkPrefixes(prefixes); err != nil {
+		respond.UnprocessableEntity(w, r, err)
+		return
+	}
+	var accept = acceptor(prefixes)
+
+	var sinceS = r.Header.Get("Last-Event-ID")
+	if sinceS == "" {
+		sinceS = utils.QueryParam(r, "since")
+	}
+	if sinceS == "" {
+		subscription = aggregatedEvents.SubscribeWhere(accept)
+	} else if since, err := strconv.ParseUint(sinceS, 10, 64); err != nil {
+		respond.UnprocessableEntity(w, r, err)
+		return
+	} else {
+		subscription, missed = subscribeSince(since, accept)
+	}
+
+	defer subscription.Close()
 
 	w.Header().Set("Connection", "keep-alive")
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.(http.Flusher).Flush()
 
+	for _, evt := range missed {
+		if err := write(w, evt); err != nil {
+			return
+		}
+	}
+	w.(http.Flusher).Flush()
+
+	// Request context is done when the client goes away, or the server shuts down
 	for {
-		var evt = subscription.Next()
-		if _, err := fmt.Fprintf(w, "event:%s\n", evt.Event); err != nil {
+		if evt, err := subscription.NextContext(r.Context()); err != nil {
 			return
-		} else if _, err := fmt.Fprintf(w, "data:%s\n\n", evt.Data); err != nil {
+		} else if err := write(w, evt); err != nil {
 			return
 		}
 		w.(http.Flusher).Flush()
 	}
+}
 
+func write(w http.ResponseWriter, evt NumberedEvent) error {
+	if evt.Id == 0 {
+		var _, err = fmt.Fprint(w, ":heartbeat\n\n")
+		return err
+	} else if _, err := fmt.Fprintf(w, "id:%d\n", evt.Id); err != nil {
+		return err
+	} else if _, err := fmt.Fprintf(w, "event:%s\n", evt.Event.Event); err != nil {
+		return err
+	} else {
+		_, err = fmt.Fprintf(w, "data:%s\n\n", bytes.TrimSpace(respond.ToJson(evt.Event)))
+		return err
+	}
 }
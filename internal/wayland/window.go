@@ -6,15 +6,19 @@
 package wayland
 
 import (
+	"context"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"sync/atomic"
+	"time"
 
 	"github.com/surlykke/refude/internal/applications"
+	"github.com/surlykke/refude/internal/health"
 	"github.com/surlykke/refude/internal/lib/entity"
 )
 
-var WindowMap = entity.MakeMap[uint64, *WaylandWindow]("/window/")
+var WindowMap = entity.Register(entity.MakeMap[uint64, *WaylandWindow]("/window/").Coalesce(50*time.Millisecond), entity.SearchOptions{})
 
 var windowUpdates = make(chan windowUpdate)
 var removals = make(chan uint64)
@@ -27,17 +31,23 @@ type windowUpdate struct {
 	state WindowStateMask
 }
 
-func Run(ignWin map[string]bool) {
+var subsystem = health.Get("wayland")
+
+// Runs until ctx is done
+func Run(ctx context.Context, ignWin map[string]bool) {
 	WindowMap.Serve()
+	subsystem.Gauge("windows", WindowMap.Len)
 	ignoredWindows = ignWin
 
 	go setupAndRunAsWaylandClient()
 
 	var appEvents = make(chan struct{})
-	go watchAppCollections(appEvents)
+	go watchAppCollections(ctx, appEvents)
 
 	for {
 		select {
+		case <-ctx.Done():
+			return
 		case upd := <-windowUpdates:
 			var (
 				title    string
@@ -83,11 +93,17 @@ func Run(ignWin map[string]bool) {
 	}
 }
 
-func watchAppCollections(sink chan struct{}) {
+func watchAppCollections(ctx context.Context, sink chan struct{}) {
 	var subscription = applications.AppMap.Events.Subscribe()
 	for {
-		subscription.Next()
-		sink <- struct{}{}
+		if _, err := subscription.NextContext(ctx); err != nil {
+			return
+		}
+		select {
+		case sink <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
 	}
 }
 
@@ -130,6 +146,33 @@ func (wsm WindowStateMask) MarshalJSON() ([]byte, error) {
 	return json.Marshal(wsm.toStringList())
 }
 
+func (wsm *WindowStateMask) UnmarshalJSON(data []byte) error {
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*wsm = 0
+	for _, s := range list {
+		switch s {
+		case "MAXIMIZED":
+			*wsm |= MAXIMIZED
+		case "MINIMIZED":
+			*wsm |= MINIMIZED
+		case "ACTIVATED":
+			*wsm |= ACTIVATED
+		case "FULLSCREEN":
+			*wsm |= FULLSCREEN
+		default:
+			return fmt.Errorf("unknown window state: %s", s)
+		}
+	}
+	return nil
+}
+
+func (wsm WindowStateMask) JSONSchema() map[string]any {
+	return map[string]any{"type": "array", "items": map[string]any{"enum": []string{"MAXIMIZED", "MINIMIZED", "ACTIVATED", "FULLSCREEN"}}}
+}
+
 type WaylandWindow struct {
 	entity.Base
 	Wid   uint64          `json:"-"`
@@ -158,7 +201,7 @@ func (this *WaylandWindow) OmitFromSearch() bool {
 	return strings.HasPrefix(this.Title, "Refude desktop") || ignoredWindows[this.AppId]
 }
 
-func (this *WaylandWindow) DoPost(action string) (bool, error) {
+func (this *WaylandWindow) DoPost(action string, args []string) (bool, error) {
 	if "" == action {
 		activate(this.Wid)
 		return true, nil
@@ -167,6 +210,34 @@ func (this *WaylandWindow) DoPost(action string) (bool, error) {
 	}
 }
 
+// Only MINIMIZED and ACTIVATED can be changed. The returned window has the requested
+// state, which the compositor will confirm (or not) shortly after.
+func (this *WaylandWindow) DoPatch(patch map[string]json.RawMessage) (entity.Servable, error) {
+	var state = this.State
+	if err := entity.CheckPatchFields(patch, "state"); err != nil {
+		return nil, err
+	} else if _, err := entity.PatchField(patch, "state", &state); err != nil {
+		return nil, err
+	} else if (state^this.State)&(MAXIMIZED|FULLSCREEN) != 0 {
+		return nil, entity.PatchError{Field: "state", Problem: "MAXIMIZED and FULLSCREEN cannot be changed"}
+	} else if this.State.Is(ACTIVATED) && !state.Is(ACTIVATED) {
+		return nil, entity.PatchError{Field: "state", Problem: "ACTIVATED can only be set, not cleared"}
+	}
+
+	if state.Is(MINIMIZED) && !this.State.Is(MINIMIZED) {
+		hide(this.Wid)
+	} else if !state.Is(MINIMIZED) && this.State.Is(MINIMIZED) {
+		show(this.Wid)
+	}
+	if state.Is(ACTIVATED) && !this.State.Is(ACTIVATED) {
+		activate(this.Wid)
+	}
+
+	var copy = *this
+	copy.State = state
+	return &copy, nil
+}
+
 var remembered atomic.Uint64
 
 func RememberActive() {
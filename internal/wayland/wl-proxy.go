@@ -30,6 +30,7 @@ void show_toplevel(uintptr_t);
 */
 import "C"
 import (
+	"errors"
 	"unsafe"
 )
 
@@ -105,4 +106,5 @@ func setupAndRunAsWaylandClient() {
 			break
 		}
 	}
+	subsystem.Fail(errors.New("lost connection to wayland display"))
 }
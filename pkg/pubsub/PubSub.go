@@ -3,62 +3,228 @@
 // This file is part of the refude project.
 // It is distributed under the GPL v2 license.
 // Please refer to the GPL2 file for a copy of the license.
-//
 package pubsub
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrClosed = errors.New("subscription closed")
 
 // Never copy
 type Publisher[T any] struct {
-	ev   *dataHolder[T]
-	lock *sync.Mutex
-	cond *sync.Cond
+	ev       *dataHolder[T]
+	lock     *sync.Mutex
+	cond     *sync.Cond
+	coalesce *coalescer[T]
+	filtered map[*Subscription[T]]struct{} // Open subscriptions made with SubscribeWhere
+}
+
+// Data published, but held back, waiting for the window to end
+type coalescer[T any] struct {
+	window  time.Duration
+	key     func(T) string
+	pending map[string]T
+	order   []string
+	timer   *time.Timer
 }
 
 func MakePublisher[T any]() *Publisher[T] {
 	var lock = &sync.Mutex{}
 	return &Publisher[T]{
-		ev: &dataHolder[T]{},
-		lock: lock,
-		cond: sync.NewCond(lock),
+		ev:       &dataHolder[T]{},
+		lock:     lock,
+		cond:     sync.NewCond(lock),
+		filtered: make(map[*Subscription[T]]struct{}),
 	}
 }
 
+/*
+ * Makes the publisher hold back what is published for window. When the window ends, what was published in it
+ * is passed on, but only the latest data for each key, in the order each key was first published.
+ * With a nil key, only the latest data is passed on. Should be called before anything is published.
+ */
+func (this *Publisher[T]) Coalesce(window time.Duration, key func(T) string) {
+	if key == nil {
+		key = func(T) string { return "" }
+	}
+	this.lock.Lock()
+	defer this.lock.Unlock()
+	this.coalesce = &coalescer[T]{window: window, key: key, pending: make(map[string]T)}
+}
+
 func (this *Publisher[T]) Publish(data T) {
 	this.lock.Lock()
+	if c := this.coalesce; c != nil {
+		var k = c.key(data)
+		if _, ok := c.pending[k]; !ok {
+			c.order = append(c.order, k)
+		}
+		c.pending[k] = data
+		if c.timer == nil {
+			c.timer = time.AfterFunc(c.window, this.flush)
+		}
+		this.lock.Unlock()
+		return
+	}
+	this.append(data)
+	this.lock.Unlock()
+	this.cond.Broadcast()
+}
+
+func (this *Publisher[T]) flush() {
+	this.lock.Lock()
+	var c = this.coalesce
+	for _, k := range c.order {
+		this.append(c.pending[k])
+	}
+	clear(c.pending)
+	c.order = c.order[:0]
+	c.timer = nil
+	this.lock.Unlock()
+	this.cond.Broadcast()
+}
+
+// Caller must hold lock. Filtered subscriptions are woken here, if they accept data. Others are woken by cond
+func (this *Publisher[T]) append(data T) {
 	this.ev.next = &dataHolder[T]{
 		next: nil,
 		data: data,
 	}
 	this.ev = this.ev.next
-	this.lock.Unlock()
-	this.cond.Broadcast()
+	for s := range this.filtered {
+		if s.accept(data) {
+			s.signal()
+		}
+	}
 }
 
 func (this *Publisher[T]) Subscribe() *Subscription[T] {
+	return this.SubscribeWhere(nil)
+}
+
+/*
+ * Like Subscribe, but the subscription only returns data for which accept returns true. A nil accept accepts all.
+ * accept is called when data is published, and a waiting subscriber is only woken if accept returns true, so
+ * many subscribers each interested in a little of what is published don't all wake on everything.
+ * accept is called with the publisher locked, so it should be quick, and not publish or subscribe.
+ * The publisher holds on to the subscription until it is closed, so it should be closed when no longer used.
+ */
+func (this *Publisher[T]) SubscribeWhere(accept func(T) bool) *Subscription[T] {
 	this.lock.Lock()
 	defer this.lock.Unlock()
-	return &Subscription[T] {
-		lock: this.lock,
-		cond: this.cond,
-		ev: this.ev,
+	var s = &Subscription[T]{
+		lock:   this.lock,
+		cond:   this.cond,
+		ev:     this.ev,
+		accept: accept,
 	}
+	if accept != nil {
+		s.wake = make(chan struct{}, 1)
+		s.filtered = this.filtered
+		this.filtered[s] = struct{}{}
+	}
+	return s
 }
 
 type Subscription[T any] struct {
-	lock *sync.Mutex
-	cond *sync.Cond
-	ev *dataHolder[T]
+	lock     *sync.Mutex
+	cond     *sync.Cond
+	ev       *dataHolder[T]
+	accept   func(T) bool
+	wake     chan struct{}                 // For filtered subscriptions, signalled instead of cond
+	filtered map[*Subscription[T]]struct{} // Where the publisher keeps it, if filtered
+	closed   bool
+}
+
+// Caller must hold lock
+func (s *Subscription[T]) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default: // Already signalled
+	}
+}
+
+// Waits for the next event. Once the subscription is closed, returns the zero value and false, right away
+func (s *Subscription[T]) Next() (T, bool) {
+	var data, err = s.NextContext(context.Background())
+	return data, err == nil
+}
+
+// Waits for the next event, until ctx is done or the subscription closed. Then ctx.Err() or ErrClosed is returned
+func (s *Subscription[T]) NextContext(ctx context.Context) (T, error) {
+	if s.wake != nil {
+		return s.nextFiltered(ctx)
+	}
+
+	// Wakes up waiters, so they can see that ctx is done
+	var stop = context.AfterFunc(ctx, func() {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for {
+		var zero T
+		if s.closed {
+			return zero, ErrClosed
+		} else if s.ev.next != nil {
+			s.ev = s.ev.next
+			if s.accept == nil || s.accept(s.ev.data) {
+				return s.ev.data, nil
+			}
+		} else if err := ctx.Err(); err != nil {
+			return zero, err
+		} else {
+			s.cond.Wait()
+		}
+	}
+}
+
+func (s *Subscription[T]) nextFiltered(ctx context.Context) (T, error) {
+	var zero T
+	for {
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			return zero, ErrClosed
+		}
+		for s.ev.next != nil {
+			s.ev = s.ev.next
+			if s.accept(s.ev.data) {
+				var data = s.ev.data
+				s.lock.Unlock()
+				return data, nil
+			}
+		}
+		s.lock.Unlock()
+
+		select {
+		case <-s.wake:
+		case <-ctx.Done():
+			return zero, ctx.Err()
+		}
+	}
 }
 
-func (s *Subscription[T]) Next() T {
+// Makes the subscription return ErrClosed from NextContext, now and from then on.
+// May be called from another goroutine than the one waiting
+func (s *Subscription[T]) Close() {
 	s.lock.Lock()
 	defer s.lock.Unlock()
-	for s.ev.next == nil {
-		s.cond.Wait()
+	s.closed = true
+	if s.wake != nil {
+		delete(s.filtered, s)
+		s.signal()
+	} else {
+		s.cond.Broadcast()
 	}
-	s.ev = s.ev.next
-	return s.ev.data
 }
 
 type dataHolder[T any] struct {
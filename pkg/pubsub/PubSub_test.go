@@ -0,0 +1,120 @@
+// Copyright (c) Christian Surlykke
+//
+// This file is part of the refude project.
+// It is distributed under the GPL v2 license.
+// Please refer to the GPL2 file for a copy of the license.
+package pubsub
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestNextContext(t *testing.T) {
+	var publisher = MakePublisher[int]()
+	var subscription = publisher.Subscribe()
+	publisher.Publish(1)
+	if i, err := subscription.NextContext(context.Background()); err != nil || i != 1 {
+		t.Errorf("Expected 1, nil, got %d, %v", i, err)
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	go func() { time.Sleep(10 * time.Millisecond); cancel() }()
+	if _, err := subscription.NextContext(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got %v", err)
+	}
+
+	// Still usable after ctx is done
+	publisher.Publish(2)
+	if i, err := subscription.NextContext(context.Background()); err != nil || i != 2 {
+		t.Errorf("Expected 2, nil, got %d, %v", i, err)
+	}
+}
+
+func TestClose(t *testing.T) {
+	var publisher = MakePublisher[int]()
+	var subscription = publisher.Subscribe()
+	go func() { time.Sleep(10 * time.Millisecond); subscription.Close() }()
+	if _, err := subscription.NextContext(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed, got %v", err)
+	}
+	publisher.Publish(1)
+	if _, err := subscription.NextContext(context.Background()); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed after close, got %v", err)
+	}
+	if _, ok := subscription.Next(); ok {
+		t.Error("Expected Next to return false after close")
+	}
+}
+
+func TestSubscribeWhere(t *testing.T) {
+	var publisher = MakePublisher[int]()
+	var subscription = publisher.SubscribeWhere(func(i int) bool { return i%2 == 0 })
+	for i := 1; i <= 4; i++ {
+		publisher.Publish(i)
+	}
+	for _, expected := range []int{2, 4} {
+		if i, err := subscription.NextContext(context.Background()); err != nil || i != expected {
+			t.Errorf("Expected %d, nil, got %d, %v", expected, i, err)
+		}
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	publisher.Publish(5)
+	if i, err := subscription.NextContext(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected 5 to be filtered out, got %d, %v", i, err)
+	}
+
+	// Only woken by what it accepts
+	publisher.Publish(7)
+	if len(subscription.wake) != 0 {
+		t.Error("Expected subscription not woken by 7")
+	}
+	publisher.Publish(8)
+	if len(subscription.wake) != 1 {
+		t.Error("Expected subscription woken by 8")
+	}
+
+	subscription.Close()
+	if len(publisher.filtered) != 0 {
+		t.Error("Expected closed subscription forgotten by publisher")
+	}
+	if _, err := subscription.NextContext(context.Background()); err != ErrClosed {
+		t.Errorf("Expected ErrClosed after close, got %v", err)
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	type keyed struct {
+		key   string
+		value int
+	}
+	var publisher = MakePublisher[keyed]()
+	publisher.Coalesce(20*time.Millisecond, func(k keyed) string { return k.key })
+	var subscription = publisher.Subscribe()
+	for i := 1; i <= 10; i++ {
+		publisher.Publish(keyed{"a", i})
+		publisher.Publish(keyed{"b", -i})
+	}
+
+	var ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if k, err := subscription.NextContext(ctx); err == nil {
+		t.Errorf("Expected nothing before the window ends, got %v", k)
+	}
+
+	for _, expected := range []keyed{{"a", 10}, {"b", -10}} {
+		if k, err := subscription.NextContext(context.Background()); err != nil || k != expected {
+			t.Errorf("Expected %v, got %v, %v", expected, k, err)
+		}
+	}
+
+	// A new window starts with the next publish
+	publisher.Publish(keyed{"b", 1})
+	if k, err := subscription.NextContext(context.Background()); err != nil || k != (keyed{"b", 1}) {
+		t.Errorf("Expected {b 1}, got %v, %v", k, err)
+	}
+}